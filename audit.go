@@ -0,0 +1,111 @@
+/*
+ * audit.go - Hand auth events to registered Auditors.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Audit operations.
+const (
+	// OpAuthenticate is an Authenticate call.
+	OpAuthenticate = "authenticate"
+	// OpChangeTok is a ChangePassword call.
+	OpChangeTok = "chauthtok"
+)
+
+// AuditEvent is one auth event handed to the Auditors.
+type AuditEvent struct {
+	Time    time.Time
+	Op      string
+	User    string
+	Service string
+	Result  PamResult
+	// Stage and Reason say why a failed call was rejected, Reason is the
+	// libpam text for the code. Both are empty on success.
+	Stage  Stage
+	Reason string
+	// Messages are the error and info texts the stack sent during the call,
+	// such as the pam_pwquality reason a new password was refused.
+	Messages []string
+}
+
+// Success reports if the event is for a call that worked.
+func (e AuditEvent) Success() bool {
+	return e.Stage == "" && e.Reason == ""
+}
+
+// Auditor receives AuditEvents. Audit is called in line with the PAM call, so
+// it should not block for long; its error is dropped, an audit failure does
+// not change the result the caller sees.
+type Auditor interface {
+	Audit(AuditEvent) error
+}
+
+var (
+	auditLock sync.RWMutex
+	auditors  []Auditor
+)
+
+// AddAuditor registers an Auditor for every call made from then on.
+func AddAuditor(a Auditor) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	auditors = append(auditors, a)
+}
+
+// audit builds the event for a finished call and hands it to the Auditors.
+func audit(o *options, op, name string, result PamResult, err error) {
+	// The Auditors are called without the lock, so one can add another.
+	// AddAuditor only appends, the slice we hold does not change under us.
+	auditLock.RLock()
+	list := auditors
+	auditLock.RUnlock()
+
+	if len(list) == 0 {
+		return
+	}
+
+	ev := AuditEvent{
+		Time:     time.Now(),
+		Op:       op,
+		User:     name,
+		Service:  o.service,
+		Result:   result,
+		Messages: o.messages,
+	}
+
+	if err != nil {
+		var perr *Error
+		if errors.As(err, &perr) {
+			ev.Stage = perr.Stage
+			ev.Reason = perr.Message
+		} else {
+			ev.Reason = err.Error()
+		}
+	}
+
+	for _, a := range list {
+		a.Audit(ev)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * audit_linux.go - Write USER_CHAUTHTOK records to the Linux audit system.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Netlink audit message types, from linux/audit.h.
+const (
+	auditUserChauthtok = 1108
+)
+
+// LinuxAuditor writes a USER_CHAUTHTOK record to the kernel audit log for each
+// failed ChangePassword, with the reason it was rejected. libpam only records
+// that the change failed, compliance rules (PCI, STIG) want to know why.
+// Writing audit records needs CAP_AUDIT_WRITE.
+//
+//	axiospam.AddAuditor(axiospam.LinuxAuditor{})
+type LinuxAuditor struct{}
+
+// Audit sends the record for failed password changes and ignores the rest.
+func (LinuxAuditor) Audit(ev AuditEvent) error {
+	if ev.Op != OpChangeTok || ev.Success() {
+		return nil
+	}
+
+	reason := ev.Result.String()
+	if ev.Reason != "" {
+		reason += ": " + ev.Reason
+	}
+	if len(ev.Messages) > 0 {
+		reason += ": " + strings.Join(ev.Messages, "; ")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "?"
+	}
+
+	msg := fmt.Sprintf("op=PAM:chauthtok acct=%s exe=%s hostname=? addr=? terminal=? stage=%s reason=%s res=failed",
+		auditValue(ev.User), auditValue(exe), ev.Stage, auditValue(reason))
+
+	return sendAudit(auditUserChauthtok, msg)
+}
+
+// auditValue encodes an untrusted string the way auditd expects, quoted if it
+// is plain text and hex if it holds spaces, quotes or control characters.
+func auditValue(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || c == '"' {
+			return fmt.Sprintf("%X", s)
+		}
+	}
+	return `"` + s + `"`
+}
+
+// sendAudit sends one user message to the kernel over netlink and waits for
+// the ack.
+func sendAudit(msgType uint16, msg string) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_AUDIT)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+
+	// struct nlmsghdr followed by the NUL terminated text
+	payload := append([]byte(msg), 0)
+	buf := make([]byte, syscall.NLMSG_HDRLEN+len(payload))
+	order := hostByteOrder()
+	order.PutUint32(buf[0:4], uint32(len(buf)))
+	order.PutUint16(buf[4:6], msgType)
+	order.PutUint16(buf[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	order.PutUint32(buf[8:12], 1)
+	order.PutUint32(buf[12:16], 0)
+	copy(buf[syscall.NLMSG_HDRLEN:], payload)
+
+	if err := syscall.Sendto(fd, buf, 0, sa); err != nil {
+		return err
+	}
+
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	reply := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, reply, 0)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(reply[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+			continue
+		}
+		if errno := int32(order.Uint32(m.Data[0:4])); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+	}
+	return nil
+}
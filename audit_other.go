@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * audit_other.go - The Linux audit system is not there on other platforms.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import "errors"
+
+// LinuxAuditor writes USER_CHAUTHTOK records to the Linux audit system, on
+// other platforms it always fails.
+type LinuxAuditor struct{}
+
+// Audit returns an error for failed password changes, there is no Linux audit
+// system to write to.
+func (LinuxAuditor) Audit(ev AuditEvent) error {
+	if ev.Op != OpChangeTok || ev.Success() {
+		return nil
+	}
+	return errors.New("linux audit not supported on this platform")
+}
@@ -0,0 +1,168 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * auditlog.go - A hash chained JSON lines audit log, written with log/slog.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// ChainAuditor is an Auditor that appends each event to a JSON lines log
+// through log/slog. Every line carries, as "prev", the SHA-256 of the line
+// before it, so an edited, dropped or reordered line breaks the chain and
+// VerifyAuditChain finds it. This is a light tamper evident trail for small
+// deployments; it does not stop someone who can rewrite the whole file.
+type ChainAuditor struct {
+	lock    sync.Mutex
+	w       io.Writer
+	buf     bytes.Buffer
+	handler slog.Handler
+	prev    string
+}
+
+// NewChainAuditor returns a ChainAuditor writing to w. prev is the hash of
+// the last line already in the log, empty for a new log.
+func NewChainAuditor(w io.Writer, prev string) *ChainAuditor {
+	a := &ChainAuditor{w: w, prev: prev}
+	a.handler = slog.NewJSONHandler(&a.buf, nil)
+	return a
+}
+
+// OpenChainAuditor opens the log at path for appending, creating it if
+// needed, and carries on the chain from its last line. Close closes the file.
+func OpenChainAuditor(path string) (*ChainAuditor, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	prev := ""
+	if last != nil {
+		prev = chainHash(last)
+	}
+	return NewChainAuditor(f, prev), nil
+}
+
+// Close will close the log, if its writer can be closed
+func (a *ChainAuditor) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Audit will write the event as one line of the log
+func (a *ChainAuditor) Audit(ev AuditEvent) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	level := slog.LevelInfo
+	if !ev.Success() {
+		level = slog.LevelWarn
+	}
+
+	r := slog.NewRecord(ev.Time, level, ev.Op, 0)
+	r.AddAttrs(
+		slog.String("user", ev.User),
+		slog.String("service", ev.Service),
+		slog.String("result", ev.Result.String()),
+	)
+	if ev.Stage != "" {
+		r.AddAttrs(slog.String("stage", string(ev.Stage)))
+	}
+	if ev.Reason != "" {
+		r.AddAttrs(slog.String("reason", ev.Reason))
+	}
+	if len(ev.Messages) > 0 {
+		r.AddAttrs(slog.Any("messages", ev.Messages))
+	}
+	r.AddAttrs(slog.String("prev", a.prev))
+
+	a.buf.Reset()
+	if err := a.handler.Handle(context.Background(), r); err != nil {
+		return err
+	}
+
+	// One write per line, so O_APPEND keeps lines whole
+	line := a.buf.Bytes()
+	if _, err := a.w.Write(line); err != nil {
+		return err
+	}
+	a.prev = chainHash(bytes.TrimSuffix(line, []byte("\n")))
+	return nil
+}
+
+// VerifyAuditChain reads a log written by ChainAuditor and checks every
+// line's "prev" against the line before it. It returns the number of lines
+// read, and an error naming the first line that does not match.
+func VerifyAuditChain(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	n := 0
+	prev := ""
+	for scanner.Scan() {
+		n++
+		var rec struct {
+			Prev *string `json:"prev"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("audit log line %d: %v", n, err)
+		}
+		if rec.Prev == nil || *rec.Prev != prev {
+			return n, fmt.Errorf("audit log line %d: chain broken", n)
+		}
+		prev = chainHash(scanner.Bytes())
+	}
+
+	return n, scanner.Err()
+}
+
+// chainHash is the hash of one log line, without its newline.
+func chainHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
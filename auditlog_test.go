@@ -0,0 +1,80 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * auditlog_test.go - Tests for the hash chained audit log.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	events := []AuditEvent{
+		{Time: time.Now(), Op: OpAuthenticate, User: "alice", Service: "login", Result: PamSuccess},
+		{Time: time.Now(), Op: OpAuthenticate, User: "bob", Service: "login", Result: PamAuthERR, Stage: StageAuthenticate, Reason: "Authentication failure"},
+		{Time: time.Now(), Op: OpChangeTok, User: "alice", Service: "passwd", Result: PamAuthTokERR, Stage: StageChangeTok, Messages: []string{"BAD PASSWORD: too short"}},
+	}
+
+	// Write across two opens, the chain must carry on
+	for i, ev := range events {
+		a, err := OpenChainAuditor(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Audit(ev); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		a.Close()
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if n, err := VerifyAuditChain(bytes.NewReader(data)); n != 3 || err != nil {
+		t.Fatalf("VerifyAuditChain = %d, %v\n%s", n, err, data)
+	}
+	if !strings.Contains(string(data), `"msg":"chauthtok"`) || !strings.Contains(string(data), `"level":"WARN"`) {
+		t.Errorf("unexpected log:\n%s", data)
+	}
+
+	// Editing a line breaks the next one
+	bad := strings.Replace(string(data), `"user":"bob"`, `"user":"eve"`, 1)
+	if n, err := VerifyAuditChain(strings.NewReader(bad)); n != 3 || err == nil {
+		t.Errorf("edited log = %d, %v", n, err)
+	}
+
+	// So does dropping one
+	lines := strings.SplitAfter(string(data), "\n")
+	if n, err := VerifyAuditChain(strings.NewReader(lines[0] + lines[2])); n != 2 || err == nil {
+		t.Errorf("log with a line dropped = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * authenticator.go - One interface for the ways a request can be checked.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import "context"
+
+// Authenticator checks an AuthRequest. PAMAuthenticator runs the PAM stack,
+// keytab.Authenticator checks machine credentials, and callers that take an
+// Authenticator work with either.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error)
+}
+
+// AuthenticatorFunc lets a plain function be used as an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, req AuthRequest) (AuthResult, error)
+
+// Authenticate calls f(ctx, req).
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	return f(ctx, req)
+}
+
+// PAMAuthenticator is an Authenticator that runs the PAM stack, the same as
+// AuthenticateContext.
+type PAMAuthenticator struct {
+	opts []Option
+}
+
+// NewPAMAuthenticator returns a PAMAuthenticator that applies opts to every
+// request.
+func NewPAMAuthenticator(opts ...Option) *PAMAuthenticator {
+	return &PAMAuthenticator{opts: opts}
+}
+
+// Authenticate will check the request with PAM
+func (a *PAMAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	return AuthenticateContext(ctx, req, a.opts...)
+}
@@ -0,0 +1,226 @@
+/*
+ * breaker.go - A circuit breaker around an Authenticator.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+// Breaker states.
+const (
+	// BreakerClosed sends requests to the primary.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen sends requests to the fallback, the primary is down.
+	BreakerOpen
+	// BreakerHalfOpen is checking if the primary is back.
+	BreakerHalfOpen
+)
+
+// breakerStates Number to Strings
+var breakerStates = [...]string{
+	"closed",
+	"open",
+	"half-open",
+}
+
+// String will convert a BreakerState to a String
+func (s BreakerState) String() string {
+	if int(s) < 0 || int(s) >= len(breakerStates) {
+		return "unknown BreakerState"
+	}
+
+	return breakerStates[s]
+}
+
+// Breaker defaults.
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned by a Breaker with no Fallback while the primary
+// is down. errors.Is(err, PamAuthInfoUnavail) is true for it.
+var ErrCircuitOpen = &Error{Code: PamAuthInfoUnavail, Message: "circuit breaker open"}
+
+// Breaker is an Authenticator that stops sending requests to a primary
+// backend that keeps failing, so an LDAP or KDC outage does not have every
+// login wait on it. After Threshold outages in a row (an *Error with code
+// SYSTEM_ERR, BUF_ERR or AUTHINFO_UNAVAIL, or a timeout, not a wrong password
+// or a policy refusal) the breaker opens and
+// requests go to the Fallback, such as a credential cache or the local
+// shadow stack, or fail at once with ErrCircuitOpen.
+//
+// Every Cooldown an open breaker checks the primary: with Probe, by calling
+// it, otherwise by letting one real request through. If that works the
+// breaker closes again. The fields must be set before first use.
+type Breaker struct {
+	Primary  Authenticator
+	Fallback Authenticator
+	// Threshold is the outages in a row that open the breaker, 5 if zero.
+	Threshold int
+	// Cooldown is the time between checks of the primary, 30s if zero.
+	Cooldown time.Duration
+	// Probe checks if the primary is back, such as a pam_start round trip or
+	// a canary login. It returns nil when it is.
+	Probe func(ctx context.Context) error
+	// OnStateChange, if set, is called on every change of state, for logging
+	// and metrics. It is called with the breaker locked and must not use it.
+	OnStateChange func(from, to BreakerState)
+
+	lock      sync.Mutex
+	state     BreakerState
+	failures  int
+	nextCheck time.Time
+}
+
+// Authenticate will check the request with the primary, or the fallback while
+// the primary is down
+func (b *Breaker) Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	if b.usePrimary(ctx) {
+		res, err := b.Primary.Authenticate(ctx, req)
+		down := outage(err)
+		b.record(down)
+		if !down || b.Fallback == nil {
+			return res, err
+		}
+	}
+
+	if b.Fallback == nil {
+		return AuthResult{Result: PamAuthInfoUnavail, User: req.User}, ErrCircuitOpen
+	}
+	return b.Fallback.Authenticate(ctx, req)
+}
+
+// State returns the current state.
+func (b *Breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+// usePrimary reports if this request should go to the primary, running the
+// Probe when an open breaker is due a check.
+func (b *Breaker) usePrimary(ctx context.Context) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		// Someone else is already checking
+		return false
+	}
+
+	if time.Now().Before(b.nextCheck) {
+		return false
+	}
+	if b.Probe == nil {
+		// Let this request through as the check
+		b.setState(BreakerHalfOpen)
+		return true
+	}
+
+	b.setState(BreakerHalfOpen)
+	b.lock.Unlock()
+	err := b.Probe(ctx)
+	b.lock.Lock()
+
+	if err != nil {
+		b.open()
+		return false
+	}
+	b.failures = 0
+	b.setState(BreakerClosed)
+	return true
+}
+
+// record counts the outcome of a request sent to the primary.
+func (b *Breaker) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	threshold := b.Threshold
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		b.open()
+	}
+}
+
+// open opens the breaker until the next check.
+func (b *Breaker) open() {
+	cooldown := b.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	b.nextCheck = time.Now().Add(cooldown)
+	b.setState(BreakerOpen)
+}
+
+// setState changes the state and tells OnStateChange.
+func (b *Breaker) setState(s BreakerState) {
+	if s == b.state {
+		return
+	}
+	if b.OnStateChange != nil {
+		b.OnStateChange(b.state, s)
+	}
+	b.state = s
+}
+
+// outage reports if an error means the backend is down, rather than the
+// user being turned away. It goes by the code of the *Error, not the result:
+// authenticate flattens an account stage refusal, such as pam_access saying
+// no, to PamSystemERR, and a user must not be able to open the breaker for
+// everyone by being refused.
+func outage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var perr *Error
+	if !errors.As(err, &perr) {
+		return false
+	}
+	switch perr.Code {
+	case PamAuthInfoUnavail, PamSystemERR, PamBufERR:
+		return true
+	}
+	return false
+}
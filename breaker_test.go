@@ -0,0 +1,159 @@
+/*
+ * breaker_test.go - Tests for the circuit breaker.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyBackend is down while down is true, and counts its calls.
+type flakyBackend struct {
+	down  bool
+	calls int
+}
+
+func (f *flakyBackend) Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	f.calls++
+	if f.down {
+		return AuthResult{Result: PamAuthERR}, newError(PamAuthInfoUnavail, StageAccount)
+	}
+	return passwordBackend("secret").Authenticate(ctx, req)
+}
+
+func TestBreaker(t *testing.T) {
+	primary := &flakyBackend{}
+	fallback := &flakyBackend{}
+	b := &Breaker{Primary: primary, Fallback: fallback, Threshold: 2, Cooldown: 20 * time.Millisecond}
+	req := AuthRequest{User: "alice", Password: "secret"}
+	ctx := context.Background()
+
+	// Wrong passwords are not outages
+	for i := 0; i < 3; i++ {
+		b.Authenticate(ctx, AuthRequest{User: "alice", Password: "wrong"})
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("opened on wrong passwords")
+	}
+
+	// Two outages open it, those two still go on to the fallback
+	primary.down = true
+	for i := 0; i < 2; i++ {
+		if _, err := b.Authenticate(ctx, req); err != nil {
+			t.Errorf("outage %d not covered by the fallback: %v", i, err)
+		}
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("state %v after outages, want open", b.State())
+	}
+
+	// While open the primary is left alone
+	calls := primary.calls
+	b.Authenticate(ctx, req)
+	if primary.calls != calls || fallback.calls != 3 {
+		t.Errorf("open breaker used the primary")
+	}
+
+	// After the cooldown one request checks it, still down so it stays open
+	time.Sleep(30 * time.Millisecond)
+	b.Authenticate(ctx, req)
+	if primary.calls != calls+1 || b.State() != BreakerOpen {
+		t.Errorf("check of a down primary: calls %d, state %v", primary.calls-calls, b.State())
+	}
+
+	// Back up, the next check closes it
+	primary.down = false
+	time.Sleep(30 * time.Millisecond)
+	if res, err := b.Authenticate(ctx, req); err != nil || res.Result != PamSuccess {
+		t.Errorf("check of a working primary = %+v (%v)", res, err)
+	}
+	if b.State() != BreakerClosed {
+		t.Errorf("state %v after recovery, want closed", b.State())
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	primary := &flakyBackend{down: true}
+	var changes []BreakerState
+	b := &Breaker{
+		Primary:   primary,
+		Threshold: 1,
+		Cooldown:  time.Millisecond,
+		Probe: func(ctx context.Context) error {
+			if primary.down {
+				return errors.New("still down")
+			}
+			return nil
+		},
+		OnStateChange: func(from, to BreakerState) { changes = append(changes, to) },
+	}
+	req := AuthRequest{User: "alice", Password: "secret"}
+
+	b.Authenticate(context.Background(), req)
+	time.Sleep(2 * time.Millisecond)
+
+	// The probe fails, so no fallback means ErrCircuitOpen
+	_, err := b.Authenticate(context.Background(), req)
+	if err != ErrCircuitOpen || !errors.Is(err, PamAuthInfoUnavail) {
+		t.Errorf("open breaker error = %v", err)
+	}
+	if primary.calls != 1 {
+		t.Errorf("probe let a request through to the primary")
+	}
+
+	primary.down = false
+	time.Sleep(2 * time.Millisecond)
+	if _, err := b.Authenticate(context.Background(), req); err != nil {
+		t.Errorf("after a good probe = %v", err)
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(changes) != len(want) {
+		t.Fatalf("state changes %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("state changes %v, want %v", changes, want)
+			break
+		}
+	}
+}
+
+func TestBreakerPolicyDenial(t *testing.T) {
+	needInlineStack(t)
+	// The account stage says no, as pam_access would, which authenticate
+	// flattens to PamSystemERR. That is the user turned away, not an outage.
+	stack := "auth required pam_permit.so\naccount required pam_deny.so\n"
+	fallback := &flakyBackend{}
+	b := &Breaker{Primary: NewPAMAuthenticator(WithInlineStack(stack)), Fallback: fallback, Threshold: 1}
+	req := AuthRequest{User: "root", Password: "secret"}
+
+	for i := 0; i < 3; i++ {
+		res, err := b.Authenticate(context.Background(), req)
+		if err == nil || res.Result != PamSystemERR {
+			t.Fatalf("denied login = %v (%v)", res.Result, err)
+		}
+	}
+	if b.State() != BreakerClosed || fallback.calls != 0 {
+		t.Errorf("policy denials opened the breaker: %v, %d fallback calls", b.State(), fallback.calls)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * catalog.go - User facing text for results and errors, per language.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Catalog maps message keys to the text shown to users in one language. The
+// keys are the PamResult names ("AUTH_ERR", "MAXTRIES", ...) plus these:
+//
+//	LOCKED_OUT       ErrLockedOut with a known end, "{until}" is replaced by it
+//	                 in local time as "2006-01-02 15:04 MST"
+//	LOGINS_DISABLED  ErrLoginsDisabled with no notice text
+//	UNKNOWN          anything else
+type Catalog map[string]string
+
+// Catalog keys that are not PamResult names.
+const (
+	KeyLockedOut      = "LOCKED_OUT"
+	KeyLoginsDisabled = "LOGINS_DISABLED"
+	KeyUnknown        = "UNKNOWN"
+)
+
+// untilLayout formats the end of a lockout, with the date as it may be days
+// away.
+const untilLayout = "2006-01-02 15:04 MST"
+
+// DefaultLanguage is the catalog used when a language, and its base language,
+// have no text for a key.
+const DefaultLanguage = "en"
+
+var (
+	catalogLock sync.RWMutex
+	catalogs    = map[string]Catalog{
+		DefaultLanguage: {
+			"SUCCESS":               "Success.",
+			"SYSTEM_ERR":            "Something went wrong, try again later.",
+			"PERM_DENIED":           "Permission denied.",
+			"AUTH_ERR":              "Incorrect username or password.",
+			"CRED_INSUFFICIENT":     "Permission denied.",
+			"AUTHINFO_UNAVAIL":      "The login service is unavailable, try again later.",
+			"USER_UNKNOWN":          "Incorrect username or password.",
+			"MAXTRIES":              "Too many failed attempts, the account is locked.",
+			"NEW_AUTHTOK_REQD":      "Your password has expired and must be changed.",
+			"ACCT_EXPIRED":          "Your account has expired.",
+			"CRED_EXPIRED":          "Your credentials have expired.",
+			"AUTHTOK_ERR":           "The new password was not accepted.",
+			"AUTHTOK_LOCK_BUSY":     "The password database is busy, try again.",
+			"AUTHTOK_DISABLE_AGING": "Your password cannot be changed yet.",
+			"TRY_AGAIN":             "The password service is busy, try again.",
+			"AUTHTOK_EXPIRED":       "Your password has expired and must be changed.",
+			KeyLockedOut:            "Too many failed attempts, try again after {until}.",
+			KeyLoginsDisabled:       "Logins are disabled for maintenance.",
+			KeyUnknown:              "Something went wrong, try again later.",
+		},
+	}
+)
+
+// RegisterCatalog adds text for a language, such as "de" or "pt-BR". Keys
+// already registered for the language are replaced, the rest are kept, so an
+// application can override just the wording it cares about.
+func RegisterCatalog(lang string, c Catalog) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+
+	cur := catalogs[lang]
+	if cur == nil {
+		cur = Catalog{}
+		catalogs[lang] = cur
+	}
+	for k, v := range c {
+		cur[k] = v
+	}
+}
+
+// Message returns the text to show a user for the result of a call in the
+// given language. err is looked at first, so the typed errors get their own
+// text, then the result. A nil error and PamSuccess give "SUCCESS".
+func Message(result PamResult, err error, lang string) string {
+	var locked ErrLockedOut
+	var nologin ErrLoginsDisabled
+	var perr *Error
+	var code PamResult
+
+	switch {
+	case errors.As(err, &locked):
+		if !locked.Until.IsZero() {
+			s := lookupMessage(lang, KeyLockedOut)
+			return strings.Replace(s, "{until}", locked.Until.Local().Format(untilLayout), -1)
+		}
+		return lookupMessage(lang, PamMaxTries.String())
+	case errors.As(err, &nologin):
+		// The administrators own notice beats anything in the catalog
+		if nologin.Message != "" {
+			return nologin.Message
+		}
+		return lookupMessage(lang, KeyLoginsDisabled)
+	case errors.As(err, &perr):
+		return lookupMessage(lang, perr.Code.String())
+	case errors.As(err, &code):
+		return lookupMessage(lang, code.String())
+	case err != nil:
+		return lookupMessage(lang, KeyUnknown)
+	}
+
+	return lookupMessage(lang, result.String())
+}
+
+// lookupMessage finds the text for a key, trying the language, its base
+// language ("pt" for "pt-BR") and then DefaultLanguage.
+func lookupMessage(lang, key string) string {
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+
+	tries := []string{lang}
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		tries = append(tries, lang[:i])
+	}
+	tries = append(tries, DefaultLanguage)
+
+	for _, l := range tries {
+		if s, ok := catalogs[l][key]; ok {
+			return s
+		}
+	}
+	for _, l := range tries {
+		if s, ok := catalogs[l][KeyUnknown]; ok {
+			return s
+		}
+	}
+	return key
+}
@@ -0,0 +1,51 @@
+/*
+ * catalog_test.go - Tests for the message catalog.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	RegisterCatalog("de", Catalog{"AUTH_ERR": "Falscher Benutzername oder Passwort."})
+	until := time.Date(2020, 3, 14, 9, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		result PamResult
+		err    error
+		lang   string
+		want   string
+	}{
+		{PamSuccess, nil, "en", "Success."},
+		{PamAuthERR, &Error{Code: PamAuthERR, Stage: StageAuthenticate}, "de-AT", "Falscher Benutzername oder Passwort."},
+		// Falls back to the default language for keys "de" does not have
+		{PamAcctExpired, nil, "de", "Your account has expired."},
+		{PamAuthERR, ErrLoginsDisabled{Message: "Back at 10:00"}, "de", "Back at 10:00"},
+		{PamMaxTries, ErrLockedOut{}, "en", "Too many failed attempts, the account is locked."},
+		{PamMaxTries, ErrLockedOut{Until: until}, "en", "Too many failed attempts, try again after 2020-03-14 09:30 " + until.Format("MST") + "."},
+	}
+
+	for _, tt := range tests {
+		if got := Message(tt.result, tt.err, tt.lang); got != tt.want {
+			t.Errorf("Message(%v, %v, %q) = %q, want %q", tt.result, tt.err, tt.lang, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * compare.go - Check a credential against two backends to validate a move.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendOutcome is what one backend said in a Comparison.
+type BackendOutcome struct {
+	Result   AuthResult
+	Err      error
+	Duration time.Duration
+}
+
+// Comparison is the outcome of one CompareBackends call, handed to the
+// comparison hooks.
+type Comparison struct {
+	Time time.Time
+	User string
+	A, B BackendOutcome
+	// Agree is true when both backends let the user in, or both turned them
+	// away. The reasons for a refusal may differ between backends.
+	Agree bool
+	// Inconclusive is true when a backend gave no answer: it was down, timed
+	// out or was cancelled. Such a Comparison neither agrees nor disagrees,
+	// Agree is false.
+	Inconclusive bool
+}
+
+var (
+	compareLock  sync.RWMutex
+	compareHooks []func(Comparison)
+)
+
+// AddComparisonHook registers fn to get every Comparison from then on. It
+// runs on its own goroutine, after both backends are done.
+func AddComparisonHook(fn func(Comparison)) {
+	compareLock.Lock()
+	defer compareLock.Unlock()
+
+	compareHooks = append(compareHooks, fn)
+}
+
+// CompareTimeout bounds how long backendB may take in CompareBackends.
+const CompareTimeout = 30 * time.Second
+
+// maxCompares caps how many backendB checks run at once, more are skipped
+// with no Comparison, so a backend that hangs can not pile up goroutines.
+const maxCompares = 64
+
+// compareRunning is how many backendB checks are running.
+var compareRunning int32
+
+// CompareBackends checks the credential with backendA and returns its answer,
+// as if it had been called alone. The same credential is also checked with
+// backendB in the background, and the two answers go to the comparison hooks.
+// This lets a move from one backend to another, such as PAM to a new LDAP
+// service, be checked against real traffic before it is switched over.
+// backendB can not change the result or slow the call down.
+func CompareBackends(user, password string, backendA, backendB Authenticator) (AuthResult, error) {
+	return CompareBackendsContext(context.Background(), user, password, backendA, backendB)
+}
+
+// CompareBackendsContext is CompareBackends with backendA bounded by ctx.
+// backendB runs on after the call returns, so it is only bounded by
+// CompareTimeout; a ctx that ends with the request does not cut it short.
+//
+// backendB only starts once backendA has answered, so when both are PAM it
+// does not hold up this call. It still takes a slot under SetConcurrencyLimit
+// like any other PAM call. A PAM backendB is a real login attempt: a refusal
+// counts toward pam_faillock and the like for the user, so a wrong password
+// counts twice. Give backendB a stack without them, see WithService.
+func CompareBackendsContext(ctx context.Context, user, password string, backendA, backendB Authenticator) (AuthResult, error) {
+	req := AuthRequest{User: user, Password: password}
+
+	a := runBackend(ctx, backendA, req)
+
+	if atomic.AddInt32(&compareRunning, 1) > maxCompares {
+		atomic.AddInt32(&compareRunning, -1)
+		return a.Result, a.Err
+	}
+
+	go func() {
+		defer atomic.AddInt32(&compareRunning, -1)
+
+		bctx, cancel := context.WithTimeout(context.Background(), CompareTimeout)
+		defer cancel()
+
+		b := runBackend(bctx, backendB, req)
+		c := Comparison{
+			Time:         time.Now(),
+			User:         user,
+			A:            a,
+			B:            b,
+			Inconclusive: noAnswer(a.Err) || noAnswer(b.Err),
+		}
+		c.Agree = !c.Inconclusive && (a.Err == nil) == (b.Err == nil)
+
+		compareLock.RLock()
+		hooks := compareHooks
+		compareLock.RUnlock()
+
+		for _, fn := range hooks {
+			fn(c)
+		}
+	}()
+
+	return a.Result, a.Err
+}
+
+// noAnswer reports if a backend error says nothing about the credential, as
+// the backend was down or its context ended.
+func noAnswer(err error) bool {
+	return outage(err) || errors.Is(err, context.Canceled)
+}
+
+// runBackend times one backend's answer.
+func runBackend(ctx context.Context, backend Authenticator, req AuthRequest) BackendOutcome {
+	start := time.Now()
+	res, err := backend.Authenticate(ctx, req)
+	return BackendOutcome{
+		Result:   res,
+		Err:      err,
+		Duration: time.Since(start),
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * compare_test.go - Tests for the dual backend check.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// passwordBackend lets in anyone whose password is want.
+func passwordBackend(want string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (AuthResult, error) {
+		if req.Password != want {
+			return AuthResult{Result: PamAuthERR, User: req.User}, newError(PamAuthERR, StageAuthenticate)
+		}
+		return AuthResult{Result: PamSuccess, User: req.User}, nil
+	})
+}
+
+// resetComparisonHooks drops the hooks a test added.
+func resetComparisonHooks() {
+	compareLock.Lock()
+	defer compareLock.Unlock()
+
+	compareHooks = nil
+}
+
+func TestCompareBackends(t *testing.T) {
+	got := make(chan Comparison, 1)
+	AddComparisonHook(func(c Comparison) { got <- c })
+	defer resetComparisonHooks()
+
+	tests := []struct {
+		password string
+		want     PamResult
+		agree    bool
+	}{
+		{"old", PamSuccess, false},
+		{"new", PamAuthERR, false},
+		{"neither", PamAuthERR, true},
+	}
+
+	for _, tt := range tests {
+		res, _ := CompareBackends("alice", tt.password, passwordBackend("old"), passwordBackend("new"))
+		if res.Result != tt.want {
+			t.Errorf("%s: result %v, want backend A's %v", tt.password, res.Result, tt.want)
+		}
+
+		select {
+		case c := <-got:
+			if c.Agree != tt.agree || c.User != "alice" {
+				t.Errorf("%s: comparison %+v", tt.password, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no comparison", tt.password)
+		}
+	}
+}
+
+func TestCompareBackendsSlowShadow(t *testing.T) {
+	slow := AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (AuthResult, error) {
+		time.Sleep(time.Second)
+		return AuthResult{Result: PamSuccess}, nil
+	})
+
+	start := time.Now()
+	CompareBackends("alice", "old", passwordBackend("old"), slow)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("call waited %v on backend B", d)
+	}
+}
+
+func TestCompareBackendsCallerContext(t *testing.T) {
+	got := make(chan Comparison, 1)
+	AddComparisonHook(func(c Comparison) { got <- c })
+	defer resetComparisonHooks()
+
+	// Backend B answers once released, unless its context ends first
+	release := make(chan struct{})
+	var deadline bool
+	held := AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (AuthResult, error) {
+		_, deadline = ctx.Deadline()
+		select {
+		case <-release:
+			return AuthResult{Result: PamSuccess}, nil
+		case <-ctx.Done():
+			return AuthResult{Result: PamSystemERR}, ctx.Err()
+		}
+	})
+
+	// The request is over as soon as A answers, B carries on
+	ctx, cancel := context.WithCancel(context.Background())
+	res, err := CompareBackendsContext(ctx, "alice", "old", passwordBackend("old"), held)
+	cancel()
+	if err != nil || res.Result != PamSuccess {
+		t.Fatalf("result %v (%v), want backend A's success", res.Result, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case c := <-got:
+		if c.B.Err != nil || !c.Agree || c.Inconclusive {
+			t.Errorf("comparison %+v", c)
+		}
+		if !deadline {
+			t.Error("backend B has no deadline")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no comparison")
+	}
+}
+
+func TestCompareBackendsInconclusive(t *testing.T) {
+	got := make(chan Comparison, 1)
+	AddComparisonHook(func(c Comparison) { got <- c })
+	defer resetComparisonHooks()
+
+	// B gives no answer about the password, whatever A said
+	errs := []error{
+		context.DeadlineExceeded,
+		context.Canceled,
+		newError(PamAuthInfoUnavail, StageAuthenticate),
+	}
+	for _, berr := range errs {
+		for _, password := range []string{"old", "wrong"} {
+			down := AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (AuthResult, error) {
+				return AuthResult{Result: PamSystemERR}, berr
+			})
+			CompareBackends("alice", password, passwordBackend("old"), down)
+
+			select {
+			case c := <-got:
+				if !c.Inconclusive || c.Agree {
+					t.Errorf("%v, %s: comparison %+v", berr, password, c)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%v, %s: no comparison", berr, password)
+			}
+		}
+	}
+}
+
+func TestCompareBackendsPAMShadow(t *testing.T) {
+	needInlineStack(t)
+	// Both backends are PAM, B takes a second
+	slow := "auth required pam_exec.so /bin/sleep 1\n" + permitStack
+	a := NewPAMAuthenticator(WithInlineStack(permitStack))
+	b := NewPAMAuthenticator(WithInlineStack(slow))
+
+	start := time.Now()
+	if _, err := CompareBackends("root", "secret", a, b); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("call waited %v on PAM backend B", d)
+	}
+}
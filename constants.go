@@ -75,23 +75,25 @@ const (
 	ruser = C.PAM_RUSER
 	// UserPrompt is the string use to prompt for a username.
 	userPrompt = C.PAM_USER_PROMPT
+	// AuthtokType is the kind of token being changed, such as "PIN".
+	authtokType = C.PAM_AUTHTOK_TYPE
 )
 
 // Flag is used as input to various PAM functions. Flags can be combined with a
 // bitwise or. Refer to the official PAM documentation for which flags are
 // accepted by which functions.
-type flag int
+type Flag int
 
 // PAM Flag types.
 const (
 	// Silent indicates that no messages should be emitted.
-	silent flag = C.PAM_SILENT
+	Silent Flag = C.PAM_SILENT
 	// DisallowNullAuthtok indicates that authorization should fail
 	// if the user does not have a registered authentication token.
-	disallowNullAuthtok = C.PAM_DISALLOW_NULL_AUTHTOK
+	DisallowNullAuthtok Flag = C.PAM_DISALLOW_NULL_AUTHTOK
 	// EstablishCred indicates that credentials should be established
 	// for the user.
-	establishCred = C.PAM_ESTABLISH_CRED
+	establishCred Flag = C.PAM_ESTABLISH_CRED
 	// DeleteCred inidicates that credentials should be deleted.
 	deleteCred = C.PAM_DELETE_CRED
 	// ReinitializeCred indicates that credentials should be fully
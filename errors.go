@@ -0,0 +1,227 @@
+/*
+ * errors.go - The error type returned for PAM failures.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// Stage is the part of the PAM transaction a result came from.
+type Stage string
+
+// PAM transaction stages.
+const (
+	// StageStart is pam_start, loading the service.
+	StageStart Stage = "start"
+	// StageAuthenticate is pam_authenticate.
+	StageAuthenticate Stage = "authenticate"
+	// StageAccount is pam_acct_mgmt.
+	StageAccount Stage = "account"
+	// StageChangeTok is pam_chauthtok.
+	StageChangeTok Stage = "chauthtok"
+	// StageLookup is a passwd lookup made outside of PAM, see UserExists.
+	StageLookup Stage = "lookup"
+	// StageGroup is a change to the local group files, see AddUserToGroup.
+	StageGroup Stage = "group"
+)
+
+// Error is returned for a failed PAM call. It holds the symbolic code, the
+// stage that failed and the text libpam gives for the code (pam_strerror).
+// errors.Is(err, code) matches on the PamResult code. Err is the more exact
+// cause when there is one, such as ErrLockedOut or the contexts error, and
+// errors.Is and errors.As see it too.
+type Error struct {
+	Code    PamResult
+	Stage   Stage
+	Message string
+	Err     error
+}
+
+// newError makes an Error for the code, with the libpam text for it.
+func newError(code PamResult, stage Stage) *Error {
+	return &Error{
+		Code:    code,
+		Stage:   stage,
+		Message: strerror(code),
+	}
+}
+
+// Error will let us use an Error as an Error
+func (e *Error) Error() string {
+	s := "pam error: " + e.Code.String()
+	if e.Stage != "" {
+		s += " (" + string(e.Stage) + ")"
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	} else if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// Unwrap returns Err, or the PamResult code when there is no Err, so errors.Is
+// and errors.As can get at it.
+func (e *Error) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return e.Code
+}
+
+// Is matches the PamResult code, as Unwrap does not return it when Err is set.
+func (e *Error) Is(target error) bool {
+	code, ok := target.(PamResult)
+	return ok && code == e.Code
+}
+
+// As fills in a PamResult with the code, as Unwrap does not return it when
+// Err is set.
+func (e *Error) As(target interface{}) bool {
+	code, ok := target.(*PamResult)
+	if ok {
+		*code = e.Code
+	}
+	return ok
+}
+
+// causeError makes an Error for a failure that did not come from libpam, such
+// as a done context, keeping err as the cause.
+func causeError(code PamResult, stage Stage, err error) *Error {
+	e := newError(code, stage)
+	e.Err = err
+	return e
+}
+
+// RequestError wraps every error returned by Authenticate, AuthenticateContext,
+// AccountFlags, ChangePassword and the PAMUser calls with what the call was
+// about, so log aggregation can group failures by service and stage without
+// parsing the text. The text is that of the wrapped error. Use RequestInfo to
+// get at it.
+type RequestError struct {
+	Service string
+	// UserHash is the hex HMAC-SHA-256 of the username, so logs can tell
+	// users apart without holding their names. The key is random for each
+	// process unless set with SetUserHashKey. Empty when there was no name.
+	UserHash string
+	RHost    string
+	// Stage is the stage of the wrapped *Error, if there is one.
+	Stage Stage
+	// Attempt is the 1 based try the error came from. Only ChangePassword
+	// and ChangeAuthTok try more than once (see WithRetry), for every other
+	// call it is always 1.
+	Attempt int
+	Err     error
+}
+
+var (
+	userHashLock sync.Mutex
+	userHashKey  []byte
+)
+
+// SetUserHashKey sets the HMAC key for RequestError.UserHash. Without one a
+// random key is made for the process, so the same user hashes differently
+// after a restart or on another host; give every process the same secret
+// key to group a users failures across them. Anyone with the key can test
+// guesses of a username against a hash, so keep it out of the logs. An empty
+// key goes back to a random one.
+func SetUserHashKey(key []byte) {
+	userHashLock.Lock()
+	defer userHashLock.Unlock()
+
+	userHashKey = nil
+	if len(key) > 0 {
+		userHashKey = append([]byte(nil), key...)
+	}
+}
+
+// userHash is the hex HMAC of the name, making the process key if need be.
+// It is empty if there is no key and none could be made.
+func userHash(name string) string {
+	userHashLock.Lock()
+	if userHashKey == nil {
+		key := make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			userHashLock.Unlock()
+			return ""
+		}
+		userHashKey = key
+	}
+	mac := hmac.New(sha256.New, userHashKey)
+	userHashLock.Unlock()
+
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Error will return the text of the wrapped error
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error, so errors.Is and errors.As see through the
+// RequestError.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// RequestInfo returns the RequestError in errs chain, if there is one.
+func RequestInfo(err error) (*RequestError, bool) {
+	var rerr *RequestError
+	if errors.As(err, &rerr) {
+		return rerr, true
+	}
+	return nil, false
+}
+
+// requestError wraps err for a call made with o for the user. A nil error
+// stays nil.
+func requestError(o *options, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := RequestInfo(err); ok {
+		return err
+	}
+
+	rerr := &RequestError{
+		Service: o.service,
+		RHost:   o.rhost,
+		Attempt: o.attempt,
+		Err:     err,
+	}
+	if rerr.Attempt < 1 {
+		// Not a retried call, so this was its only try
+		rerr.Attempt = 1
+	}
+	if name != "" {
+		rerr.UserHash = userHash(name)
+	}
+	var perr *Error
+	if errors.As(err, &perr) {
+		rerr.Stage = perr.Stage
+	}
+	return rerr
+}
@@ -0,0 +1,60 @@
+/*
+ * errors_test.go - Tests for the request errors.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRequestErrorUserHash(t *testing.T) {
+	defer SetUserHashKey(nil)
+	o := newOptions(nil)
+	err := newError(PamAuthERR, StageAuthenticate)
+
+	plain := sha256.Sum256([]byte("alice"))
+	info, _ := RequestInfo(requestError(o, "alice", err))
+	if info.UserHash == "" || info.UserHash == hex.EncodeToString(plain[:]) {
+		t.Errorf("UserHash %q is empty or an unkeyed hash", info.UserHash)
+	}
+
+	// The same key gives the same hash, another key another one
+	SetUserHashKey([]byte("shared secret"))
+	first, _ := RequestInfo(requestError(o, "alice", err))
+	again, _ := RequestInfo(requestError(o, "alice", err))
+	SetUserHashKey([]byte("other secret"))
+	other, _ := RequestInfo(requestError(o, "alice", err))
+
+	if first.UserHash != again.UserHash || first.UserHash == other.UserHash {
+		t.Errorf("hashes %q %q %q", first.UserHash, again.UserHash, other.UserHash)
+	}
+}
+
+func TestRequestErrorContextStage(t *testing.T) {
+	o := newOptions(nil)
+	err := causeError(PamSystemERR, StageStart, context.DeadlineExceeded)
+
+	info, _ := RequestInfo(requestError(o, "alice", err))
+	if info.Stage != StageStart || info.Attempt != 1 {
+		t.Errorf("unexpected RequestError %+v", info)
+	}
+}
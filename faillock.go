@@ -0,0 +1,194 @@
+/*
+ * faillock.go - Read the pam_faillock tally to find when a lock out ends.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// ErrLockedOut is the Err of the *Error returned when the PAM stack answers
+// MAXTRIES, get at it with errors.As. Until is when
+// pam_faillock will let the user try again; it is the zero Time if faillock
+// is not in use, its tally could not be read (it normally needs root), or the
+// lock out only ends when an administrator clears it.
+type ErrLockedOut struct {
+	Until time.Time
+}
+
+// Error will let us use an ErrLockedOut as an Error
+func (e ErrLockedOut) Error() string {
+	if e.Until.IsZero() {
+		return "account locked out"
+	}
+	return "account locked out until " + e.Until.Format(time.RFC3339)
+}
+
+// Is lets errors.Is(err, PamMaxTries) keep working for callers that checked
+// the bare PamResult before.
+func (e ErrLockedOut) Is(target error) bool {
+	return target == PamMaxTries
+}
+
+// Remaining is how much longer the lock out lasts, or 0 if it is over or not
+// known.
+func (e ErrLockedOut) Remaining() time.Duration {
+	if e.Until.IsZero() {
+		return 0
+	}
+	if d := time.Until(e.Until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Defaults and locations used by pam_faillock, see faillock.conf(5).
+const (
+	faillockConf        = "/etc/security/faillock.conf"
+	faillockDir         = "/var/run/faillock"
+	faillockDeny        = 3
+	faillockUnlockTime  = 600
+	faillockInterval    = 900
+	faillockRecordSize  = 64
+	faillockStatusValid = 0x1
+)
+
+// faillockConfig is the part of faillock.conf needed to work out a lock out.
+type faillockConfig struct {
+	dir          string
+	deny         int
+	unlockTime   time.Duration // 0 means never unlock
+	failInterval time.Duration
+}
+
+// lockedOut builds the error returned for a MAXTRIES result, filling in
+// Until from the faillock tally when we can.
+func lockedOut(username string, stage Stage) error {
+	conf := readFaillockConfig(faillockConf)
+	until, _ := faillockUntil(conf, username)
+	return causeError(PamMaxTries, stage, ErrLockedOut{Until: until})
+}
+
+// readFaillockConfig reads faillock.conf, falling back to the module
+// defaults for anything missing or unreadable.
+func readFaillockConfig(path string) faillockConfig {
+	conf := faillockConfig{
+		dir:          faillockDir,
+		deny:         faillockDeny,
+		unlockTime:   faillockUnlockTime * time.Second,
+		failInterval: faillockInterval * time.Second,
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return conf
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "dir":
+			conf.dir = value
+		case "deny":
+			if n, err := strconv.Atoi(value); err == nil {
+				conf.deny = n
+			}
+		case "unlock_time":
+			if value == "never" {
+				conf.unlockTime = 0
+			} else if n, err := strconv.Atoi(value); err == nil {
+				conf.unlockTime = time.Duration(n) * time.Second
+			}
+		case "fail_interval":
+			if n, err := strconv.Atoi(value); err == nil {
+				conf.failInterval = time.Duration(n) * time.Second
+			}
+		}
+	}
+
+	return conf
+}
+
+// faillockUntil reads the users tally file and returns the time the lock out
+// ends. The zero Time is returned if the user is not locked by the tally or
+// the lock never ends by itself.
+func faillockUntil(conf faillockConfig, username string) (time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(conf.dir, username))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	order := hostByteOrder()
+
+	// struct tally { char source[52]; uint16_t reserved; uint16_t status; uint64_t time; }
+	var failures []time.Time
+	var latest time.Time
+	for off := 0; off+faillockRecordSize <= len(data); off += faillockRecordSize {
+		rec := data[off : off+faillockRecordSize]
+		if order.Uint16(rec[54:56])&faillockStatusValid == 0 {
+			continue
+		}
+		when := time.Unix(int64(order.Uint64(rec[56:64])), 0)
+		failures = append(failures, when)
+		if when.After(latest) {
+			latest = when
+		}
+	}
+
+	// Only failures within fail_interval of the latest one count to deny.
+	count := 0
+	for _, when := range failures {
+		if latest.Sub(when) <= conf.failInterval {
+			count++
+		}
+	}
+
+	if conf.deny <= 0 || count < conf.deny || conf.unlockTime == 0 {
+		return time.Time{}, nil
+	}
+
+	return latest.Add(conf.unlockTime), nil
+}
+
+// hostByteOrder is the byte order the tally records are written in.
+func hostByteOrder() binary.ByteOrder {
+	if one := uint16(1); *(*byte)(unsafe.Pointer(&one)) == 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
@@ -0,0 +1,99 @@
+/*
+ * faillock_test.go - Tests for reading the pam_faillock tally.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTally(t *testing.T, dir, user string, times ...int64) {
+	var data []byte
+	for _, when := range times {
+		rec := make([]byte, faillockRecordSize)
+		copy(rec, "192.0.2.1")
+		hostByteOrder().PutUint16(rec[54:56], faillockStatusValid)
+		hostByteOrder().PutUint64(rec[56:64], uint64(when))
+		data = append(data, rec...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, user), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaillockUntil(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faillock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := faillockConfig{dir: dir, deny: 3, unlockTime: 10 * time.Minute, failInterval: 15 * time.Minute}
+
+	writeTally(t, dir, "locked", 1000, 1100, 1200)
+	until, err := faillockUntil(conf, "locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1200, 0).Add(10 * time.Minute); !until.Equal(want) {
+		t.Errorf("until = %v, want %v", until, want)
+	}
+
+	// The first failure falls outside fail_interval, so only two count.
+	writeTally(t, dir, "stale", 0, 1100, 1200)
+	if until, _ := faillockUntil(conf, "stale"); !until.IsZero() {
+		t.Errorf("stale tally should not be locked, got %v", until)
+	}
+
+	conf.unlockTime = 0
+	if until, _ := faillockUntil(conf, "locked"); !until.IsZero() {
+		t.Errorf("unlock_time=never should give the zero time, got %v", until)
+	}
+}
+
+func TestErrLockedOutIs(t *testing.T) {
+	if !errors.Is(ErrLockedOut{}, PamMaxTries) {
+		t.Error("ErrLockedOut should match PamMaxTries")
+	}
+}
+
+func TestLockedOutError(t *testing.T) {
+	err := lockedOut("nobody", StageAuthenticate)
+
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Code != PamMaxTries || perr.Stage != StageAuthenticate {
+		t.Fatalf("expected a MAXTRIES *Error, got %T: %v", err, err)
+	}
+	var locked ErrLockedOut
+	if !errors.As(err, &locked) {
+		t.Errorf("errors.As(%v, ErrLockedOut) = false", err)
+	}
+	var code PamResult
+	if !errors.As(err, &code) || code != PamMaxTries {
+		t.Errorf("errors.As(%v, PamResult) = %v", err, code)
+	}
+	if !errors.Is(err, PamMaxTries) {
+		t.Errorf("errors.Is(%v, PamMaxTries) = false", err)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build axiospam_fake
+// +build axiospam_fake
+
+/*
+ * fakepam.go - Drive the conversation callback without a PAM stack.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+// The fake conversation is only for tests, so it is only built with the
+// axiospam_fake tag: go test -tags axiospam_fake
+
+package axiospam
+
+/*
+#include <security/pam_appl.h>
+#include <stdlib.h>
+
+#include "pam.h"
+
+// fakeConversation calls the conversation for id the way libpam does. A
+// negative style sends a NULL message pointer, a NULL text a message with a
+// NULL msg. On success the answers are moved to out, which has room for n.
+static int fakeConversation(uintptr_t id, int n, const int* styles,
+                            char** texts, char** out) {
+  struct pam_conv* conv = newConv(id);
+  int size = n > 0 ? n : 1;
+  struct pam_message* m = calloc(size, sizeof *m);
+  const struct pam_message** mp = calloc(size, sizeof *mp);
+  struct pam_response* resp = NULL;
+  int i, rc;
+
+  for (i = 0; i < n; ++i) {
+    m[i].msg_style = styles[i];
+    m[i].msg = texts[i];
+    mp[i] = styles[i] < 0 ? NULL : &m[i];
+  }
+
+  rc = conv->conv(n, mp, &resp, conv->appdata_ptr);
+  if (resp) {
+    for (i = 0; i < n; ++i) {
+      out[i] = resp[i].resp;
+    }
+    free(resp);
+  }
+
+  free(mp);
+  free(m);
+  free(conv);
+  return rc;
+}
+*/
+import "C"
+
+import "unsafe"
+
+// fakeMessage is one message for fakeConversation, it stands in for what a
+// PAM module would send. Style -1 is a NULL message, nilText a NULL msg text.
+type fakeMessage struct {
+	style   MessageStyle
+	text    string
+	nilText bool
+}
+
+// fakeConversation runs the conversation callback for one call from a
+// module, with c as the current conversation, so it can be tested with any
+// input, good or bad. It returns what the callback returned and the answer
+// to each message. If the callback failed but still gave answers back, ok is
+// false.
+func fakeConversation(c *conversation, msgs []fakeMessage) (result PamResult, answers []string, ok bool) {
+	id := addConversation(c)
+	defer removeConversation(id)
+
+	n := len(msgs)
+	size := C.size_t(n + 1)
+	styles := (*[1 << 28]C.int)(C.calloc(size, C.sizeof_int))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&styles[0]))
+	texts := (*[1 << 28]*C.char)(C.calloc(size, C.size_t(unsafe.Sizeof((*C.char)(nil)))))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&texts[0]))
+	out := (*[1 << 28]*C.char)(C.calloc(size, C.size_t(unsafe.Sizeof((*C.char)(nil)))))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&out[0]))
+
+	for i, m := range msgs {
+		styles[i] = C.int(m.style)
+		if !m.nilText {
+			texts[i] = C.CString(m.text)
+			defer C.free(unsafe.Pointer(texts[i]))
+		}
+	}
+
+	result = PamResult(C.fakeConversation(C.uintptr_t(id), C.int(n), &styles[0], &texts[0], &out[0]))
+
+	ok = true
+	answers = make([]string, n)
+	for i := 0; i < n; i++ {
+		if out[i] == nil {
+			continue
+		}
+		if result != PamSuccess {
+			ok = false
+		}
+		answers[i] = C.GoString(out[i])
+		C.free(unsafe.Pointer(out[i]))
+	}
+	return result, answers, ok
+}
@@ -0,0 +1,72 @@
+//go:build go1.18 && axiospam_fake
+// +build go1.18,axiospam_fake
+
+/*
+ * fakepam_fuzz_test.go - Fuzz the conversation callback.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzConversation sends the callback a run of messages cut from text, with
+// styles taken from the bytes of styles. Run it with
+//
+//	go test -run NONE -fuzz FuzzConversation
+func FuzzConversation(f *testing.F) {
+	f.Add([]byte{1}, "Password: ", "secret")
+	f.Add([]byte{3, 1, 2}, "Welcome\nPassword: \nNew password: ", "secret")
+	f.Add([]byte{7, 0xff}, "binary\n", "secret")
+	f.Add([]byte{1, 1}, "Verification code: \x00\nPlease touch the device.", "sec\x00ret")
+
+	f.Fuzz(func(t *testing.T, styles []byte, text, password string) {
+		parts := strings.Split(text, "\n")
+		var msgs []fakeMessage
+		for i, b := range styles {
+			m := fakeMessage{style: MessageStyle(int8(b))}
+			if i < len(parts) {
+				m.text = parts[i]
+			} else {
+				m.nilText = true
+			}
+			msgs = append(msgs, m)
+		}
+
+		c := newConversation(newOptions(nil), password, password)
+		got, answers, ok := fakeConversation(c, msgs)
+		if !ok {
+			t.Fatalf("answers handed back with %v", got)
+		}
+		if got != PamSuccess {
+			return
+		}
+		for _, a := range answers {
+			if len(a) >= 512 || strings.IndexByte(a, 0) >= 0 {
+				t.Errorf("answer over the limits: %q", a)
+			}
+		}
+		for _, m := range c.messages {
+			if len(m) > 512 {
+				t.Errorf("message kept at %d bytes", len(m))
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+//go:build axiospam_fake
+// +build axiospam_fake
+
+/*
+ * fakepam_test.go - Tests for the conversation callback with bad input.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFakeConversation(t *testing.T) {
+	huge := "Password: " + strings.Repeat("x", 1<<20)
+	many := make([]fakeMessage, 33)
+	for i := range many {
+		many[i] = fakeMessage{style: TextInfo, text: "hello"}
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		msgs     []fakeMessage
+		want     PamResult
+		answers  []string
+	}{
+		{"password", "secret", []fakeMessage{{style: PromptEchoOff, text: "Password: "}}, PamSuccess, []string{"secret"}},
+		{"info then prompt", "secret", []fakeMessage{{style: TextInfo, text: "hi"}, {style: PromptEchoOff, text: "Password: "}}, PamSuccess, []string{"", "secret"}},
+		{"no messages", "secret", nil, PamConvERR, nil},
+		{"too many messages", "secret", many, PamConvERR, nil},
+		{"bad style", "secret", []fakeMessage{{style: 99, text: "Password: "}}, PamConvERR, nil},
+		// Used to hand back the first answer a second time
+		{"prompt then bad style", "secret", []fakeMessage{{style: PromptEchoOff, text: "Password: "}, {style: 7, text: "binary"}}, PamConvERR, nil},
+		{"null message", "secret", []fakeMessage{{style: -1}}, PamConvERR, nil},
+		{"null text", "secret", []fakeMessage{{style: PromptEchoOff, nilText: true}}, PamSuccess, []string{"secret"}},
+		{"null info text", "secret", []fakeMessage{{style: ErrorMsg, nilText: true}}, PamSuccess, []string{""}},
+		{"huge prompt", "secret", []fakeMessage{{style: PromptEchoOff, text: huge}}, PamSuccess, []string{"secret"}},
+		{"nul in prompt", "secret", []fakeMessage{{style: PromptEchoOff, text: "Password: \x00junk"}}, PamSuccess, []string{"secret"}},
+		{"nul in answer", "sec\x00ret", []fakeMessage{{style: PromptEchoOff, text: "Password: "}}, PamConvERR, nil},
+		{"answer too long", strings.Repeat("x", 512), []fakeMessage{{style: PromptEchoOff, text: "Password: "}}, PamConvERR, nil},
+		{"longest answer", strings.Repeat("x", 511), []fakeMessage{{style: PromptEchoOff, text: "Password: "}}, PamSuccess, []string{strings.Repeat("x", 511)}},
+	}
+
+	for _, tt := range tests {
+		c := newConversation(newOptions(nil), tt.password, "")
+		got, answers, ok := fakeConversation(c, tt.msgs)
+		if got != tt.want || !ok {
+			t.Errorf("%s: result %v (ok %v), want %v", tt.name, got, ok, tt.want)
+			continue
+		}
+		if got == PamSuccess && strings.Join(answers, "|") != strings.Join(tt.answers, "|") {
+			t.Errorf("%s: answers %q, want %q", tt.name, answers, tt.answers)
+		}
+	}
+}
+
+func TestFakeConversationMessageLimits(t *testing.T) {
+	c := newConversation(newOptions(nil), "secret", "")
+
+	for i := 0; i < 1000; i++ {
+		msgs := []fakeMessage{{style: ErrorMsg, text: strings.Repeat("e", 4096)}}
+		if got, _, _ := fakeConversation(c, msgs); got != PamSuccess {
+			t.Fatalf("message %d: %v", i, got)
+		}
+	}
+
+	if len(c.messages) != maxMessages {
+		t.Errorf("kept %d messages, want %d", len(c.messages), maxMessages)
+	}
+	if len(c.messages[0]) != 512 {
+		t.Errorf("message is %d bytes, want 512", len(c.messages[0]))
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * firstlogin.go - Run provisioning hooks on a users first login.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SeenUserStore remembers which users have logged in before, for
+// OnFirstLogin. It has to outlive the process for the hook to run only once
+// per user, see NewFileSeenStore.
+type SeenUserStore interface {
+	Seen(user string) (bool, error)
+	MarkSeen(user string) error
+}
+
+// firstLoginHook is one OnFirstLogin registration.
+type firstLoginHook struct {
+	store SeenUserStore
+	fn    func(user string) error
+}
+
+// firstLoginKey is a hook running for a user.
+type firstLoginKey struct {
+	hook *firstLoginHook
+	user string
+}
+
+var (
+	firstLoginLock    sync.Mutex
+	firstLoginHooks   []*firstLoginHook
+	firstLoginRunning = map[firstLoginKey]bool{}
+)
+
+// OnFirstLogin registers fn to run after a users first successful
+// authentication, any that returns no error, as told by store, to create
+// profile rows, home directories or quotas. That takes in PamNewAuthTokReqd,
+// as a new account often has to set its password first. It runs in line with
+// the Authenticate call, before it returns. The user is only marked seen once
+// fn returns nil, so a failed hook is tried again on the next login. Its error
+// is dropped, it does not change the result the caller sees.
+//
+// Hooks for different users run at the same time. Within the process a hook
+// runs once at a time for a user, a login while it runs does not run it
+// again. Processes sharing a store may both run the hook for a user logging
+// in to each at the same moment.
+func OnFirstLogin(store SeenUserStore, fn func(user string) error) {
+	firstLoginLock.Lock()
+	defer firstLoginLock.Unlock()
+
+	firstLoginHooks = append(firstLoginHooks, &firstLoginHook{store: store, fn: fn})
+}
+
+// firstLogin runs the OnFirstLogin hooks after a successful authentication.
+// The lock is only held to claim a hook for the user, the store and the hook
+// itself run without it, so a slow hook does not hold up other logins.
+func firstLogin(user string, err error) {
+	if err != nil || user == "" {
+		return
+	}
+
+	firstLoginLock.Lock()
+	hooks := firstLoginHooks
+	firstLoginLock.Unlock()
+
+	for _, h := range hooks {
+		key := firstLoginKey{hook: h, user: user}
+		if !claimFirstLogin(key) {
+			continue
+		}
+
+		seen, err := h.store.Seen(user)
+		if err == nil && !seen && h.fn(user) == nil {
+			h.store.MarkSeen(user)
+		}
+
+		firstLoginLock.Lock()
+		delete(firstLoginRunning, key)
+		firstLoginLock.Unlock()
+	}
+}
+
+// claimFirstLogin marks the hook as running for the user, it reports false
+// if it already was.
+func claimFirstLogin(key firstLoginKey) bool {
+	firstLoginLock.Lock()
+	defer firstLoginLock.Unlock()
+
+	if firstLoginRunning[key] {
+		return false
+	}
+	firstLoginRunning[key] = true
+	return true
+}
+
+// MemorySeenStore is a SeenUserStore kept in memory, it forgets everyone
+// when the process ends.
+type MemorySeenStore struct {
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+// NewMemorySeenStore returns an empty MemorySeenStore.
+func NewMemorySeenStore() *MemorySeenStore {
+	return &MemorySeenStore{seen: map[string]bool{}}
+}
+
+// Seen reports if the user was marked seen
+func (s *MemorySeenStore) Seen(user string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.seen[user], nil
+}
+
+// MarkSeen will remember the user
+func (s *MemorySeenStore) MarkSeen(user string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seen[user] = true
+	return nil
+}
+
+// FileSeenStore is a SeenUserStore kept in a file, one username per line.
+// Users are appended as they are marked, so the file can be shared with
+// tools that just read it.
+type FileSeenStore struct {
+	mem  *MemorySeenStore
+	path string
+}
+
+// NewFileSeenStore loads the users already in the file at path, which does
+// not need to exist yet.
+func NewFileSeenStore(path string) (*FileSeenStore, error) {
+	s := &FileSeenStore{mem: NewMemorySeenStore(), path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if user := scanner.Text(); user != "" {
+			s.mem.seen[user] = true
+		}
+	}
+	return s, scanner.Err()
+}
+
+// Seen reports if the user is in the file
+func (s *FileSeenStore) Seen(user string) (bool, error) {
+	return s.mem.Seen(user)
+}
+
+// MarkSeen will add the user to the file
+func (s *FileSeenStore) MarkSeen(user string) error {
+	s.mem.lock.Lock()
+	defer s.mem.lock.Unlock()
+
+	if s.mem.seen[user] {
+		return nil
+	}
+	if user == "" || strings.ContainsAny(user, "\r\n") {
+		return errors.New("username can not be stored")
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(user + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.mem.seen[user] = true
+	return nil
+}
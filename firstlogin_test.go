@@ -0,0 +1,128 @@
+/*
+ * firstlogin_test.go - Tests for the seen user stores.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetFirstLogin drops the hooks a test added.
+func resetFirstLogin() {
+	firstLoginLock.Lock()
+	defer firstLoginLock.Unlock()
+
+	firstLoginHooks = nil
+}
+
+func TestFileSeenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen")
+
+	s, err := NewFileSeenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := s.Seen("alice"); seen {
+		t.Errorf("alice seen in a new store")
+	}
+	if err := s.MarkSeen("alice"); err != nil {
+		t.Fatal(err)
+	}
+	s.MarkSeen("alice")
+	if err := s.MarkSeen("bad\nname"); err == nil {
+		t.Errorf("stored a name with a newline")
+	}
+
+	// A new store from the same file still knows alice, once
+	s, err = NewFileSeenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := s.Seen("alice"); !seen {
+		t.Errorf("alice not seen after reload")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "alice\n" {
+		t.Errorf("file = %q", data)
+	}
+}
+
+func TestFirstLoginNoError(t *testing.T) {
+	var calls []string
+	OnFirstLogin(NewMemorySeenStore(), func(user string) error {
+		calls = append(calls, user)
+		return nil
+	})
+	defer resetFirstLogin()
+
+	firstLogin("alice", newError(PamAuthERR, StageAuthenticate))
+	if len(calls) != 0 {
+		t.Fatalf("hook ran for a failed login: %q", calls)
+	}
+	// A new account that must set its password still counts
+	firstLogin("alice", nil)
+	firstLogin("alice", nil)
+	if len(calls) != 1 {
+		t.Errorf("hook calls = %q, want one for alice", calls)
+	}
+}
+
+func TestFirstLoginSlowHook(t *testing.T) {
+	release := make(chan struct{})
+	ran := make(chan string, 3)
+	OnFirstLogin(NewMemorySeenStore(), func(user string) error {
+		ran <- user
+		if user == "slow" {
+			<-release
+		}
+		return nil
+	})
+	defer resetFirstLogin()
+
+	go firstLogin("slow", nil)
+	if user := <-ran; user != "slow" {
+		t.Fatalf("first hook ran for %q", user)
+	}
+
+	// Neither another user nor a second login for the same one waits on it
+	done := make(chan struct{})
+	go func() {
+		firstLogin("slow", nil)
+		firstLogin("fast", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logins held up behind a slow hook")
+	}
+	close(release)
+
+	if user := <-ran; user != "fast" {
+		t.Errorf("hook ran again for %q", user)
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ * group.go - Add and remove users from local groups.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+/*
+#include <shadow.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The group files edited by AddUserToGroup and RemoveUserFromGroup.
+var (
+	groupFile   = "/etc/group"
+	gshadowFile = "/etc/gshadow"
+)
+
+// The group calls return an *Error with StageGroup, these are its Err when
+// the change was refused.
+var (
+	// ErrNotPrivileged is the cause when the group calls are not run as root.
+	ErrNotPrivileged = errors.New("group changes need root")
+	// ErrUserNotFound is the cause when adding a user the system does not know.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrGroupNotFound is the cause when the group is not in /etc/group. Groups
+	// from LDAP or SSSD can not be changed here.
+	ErrGroupNotFound = errors.New("group not found in local group file")
+)
+
+// AddUserToGroup adds the user to a local group's member list in /etc/group
+// and /etc/gshadow, the same way gpasswd -a does. Adding a user who is already
+// a member does nothing. It must be run as root.
+func AddUserToGroup(user, group string) error {
+	if os.Geteuid() != 0 {
+		return causeError(PamPermDenied, StageGroup, ErrNotPrivileged)
+	}
+	exists, err := lookupUser(user)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return causeError(PamUserUnknown, StageGroup, ErrUserNotFound)
+	}
+	return editGroupMembers(user, group, true)
+}
+
+// RemoveUserFromGroup takes the user out of a local group's member list in
+// /etc/group and /etc/gshadow, the same way gpasswd -d does. Removing a user
+// who is not a member does nothing. It must be run as root.
+func RemoveUserFromGroup(user, group string) error {
+	if os.Geteuid() != 0 {
+		return causeError(PamPermDenied, StageGroup, ErrNotPrivileged)
+	}
+	return editGroupMembers(user, group, false)
+}
+
+// editGroupMembers adds or removes the user while holding the password file
+// lock (lckpwdf), so it does not race useradd, passwd or gpasswd. Both files
+// are written out before either is put in place, so a failed write leaves
+// them agreeing.
+func editGroupMembers(user, group string, add bool) error {
+	if C.lckpwdf() != 0 {
+		return causeError(PamSystemERR, StageGroup, errors.New("could not lock the password files"))
+	}
+	defer C.ulckpwdf()
+
+	var files []*stagedFile
+	defer func() {
+		for _, f := range files {
+			f.discard()
+		}
+	}()
+
+	// /etc/group: name:password:gid:members
+	f, found, err := stageMembers(groupFile, group, 3, user, add)
+	if err != nil {
+		return causeError(PamSystemERR, StageGroup, err)
+	}
+	if !found {
+		return causeError(PamSystemERR, StageGroup, ErrGroupNotFound)
+	}
+	files = append(files, f)
+
+	// /etc/gshadow: name:password:admins:members, it may not be there
+	f, _, err = stageMembers(gshadowFile, group, 3, user, add)
+	if err != nil && !os.IsNotExist(err) {
+		return causeError(PamSystemERR, StageGroup, err)
+	}
+	files = append(files, f)
+
+	if err := commitAll(files); err != nil {
+		return causeError(PamSystemERR, StageGroup, err)
+	}
+	return nil
+}
+
+// commitAll puts the staged files in place in order. If one fails the ones
+// before it get their old content back, so the files still agree.
+func commitAll(files []*stagedFile) error {
+	for i, f := range files {
+		if err := f.commit(); err != nil {
+			for _, done := range files[:i] {
+				done.rollback()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// stageMembers changes the member list, the field at index field, of the
+// group line in path and writes the result to a temporary file, ready to be
+// put in place with commit. The staged file is nil if the list did not
+// change.
+func stageMembers(path, group string, field int, user string, add bool) (*stagedFile, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	found, changed := false, false
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) <= field || fields[0] != group {
+			continue
+		}
+		found = true
+
+		var members []string
+		if fields[field] != "" {
+			members = strings.Split(fields[field], ",")
+		}
+		members, changed = editMembers(members, user, add)
+		fields[field] = strings.Join(members, ",")
+		lines[i] = strings.Join(fields, ":")
+		break
+	}
+
+	if !changed {
+		return nil, found, nil
+	}
+	f, err := stageFile(path, []byte(strings.Join(lines, "\n")))
+	return f, found, err
+}
+
+// editMembers adds or removes the user from the list, reporting if it changed.
+func editMembers(members []string, user string, add bool) ([]string, bool) {
+	for i, m := range members {
+		if m != user {
+			continue
+		}
+		if add {
+			return members, false
+		}
+		return append(members[:i], members[i+1:]...), true
+	}
+
+	if !add {
+		return members, false
+	}
+	return append(members, user), true
+}
+
+// stagedFile is new content for path, written to tmp in the same directory
+// with the mode and owner of path, waiting to be renamed over it.
+type stagedFile struct {
+	path string
+	tmp  string
+	info os.FileInfo
+	old  []byte // the content replaced by commit
+}
+
+// stageFile writes data to a temporary file next to path, keeping the mode
+// and owner.
+func stageFile(path string, data []byte) (*stagedFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"+")
+	if err != nil {
+		return nil, err
+	}
+	f := &stagedFile{path: path, tmp: tmp.Name(), info: info}
+
+	if err := writeLike(tmp, data, info); err != nil {
+		tmp.Close()
+		f.discard()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		f.discard()
+		return nil, err
+	}
+	return f, nil
+}
+
+// commit keeps the old file as path-, the way the shadow tools do, and puts
+// the new one in place in one rename so readers never see half a file. A nil
+// stagedFile has nothing to do.
+func (f *stagedFile) commit() error {
+	if f == nil {
+		return nil
+	}
+	if old, err := ioutil.ReadFile(f.path); err == nil {
+		f.old = old
+		f.backup(old)
+	}
+	return os.Rename(f.tmp, f.path)
+}
+
+// rollback puts back the content commit replaced, the same way commit put the
+// new content in place.
+func (f *stagedFile) rollback() error {
+	if f == nil || f.old == nil {
+		return nil
+	}
+	back, err := stageFile(f.path, f.old)
+	if err != nil {
+		return err
+	}
+	return os.Rename(back.tmp, f.path)
+}
+
+// backup writes the old content to path- with the mode and owner of path. A
+// failed backup does not stop the change.
+func (f *stagedFile) backup(old []byte) {
+	b, err := os.OpenFile(f.path+"-", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	writeLike(b, old, f.info)
+	b.Close()
+}
+
+// discard removes the temporary file, if it is still there.
+func (f *stagedFile) discard() {
+	if f != nil {
+		os.Remove(f.tmp)
+	}
+}
+
+// writeLike writes data to file and gives it the mode and owner from info.
+func writeLike(file *os.File, data []byte, info os.FileInfo) error {
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := file.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
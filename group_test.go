@@ -0,0 +1,164 @@
+/*
+ * group_test.go - Tests for the group member editing.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewriteMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "group")
+	orig := "root:x:0:\nwheel:x:10:alice\ndocker:x:998:\n"
+	if err := ioutil.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		group string
+		user  string
+		add   bool
+		found bool
+		want  string
+	}{
+		{"wheel", "bob", true, true, "root:x:0:\nwheel:x:10:alice,bob\ndocker:x:998:\n"},
+		{"wheel", "bob", true, true, "root:x:0:\nwheel:x:10:alice,bob\ndocker:x:998:\n"},
+		{"docker", "bob", true, true, "root:x:0:\nwheel:x:10:alice,bob\ndocker:x:998:bob\n"},
+		{"wheel", "alice", false, true, "root:x:0:\nwheel:x:10:bob\ndocker:x:998:bob\n"},
+		{"wheel", "carol", false, true, "root:x:0:\nwheel:x:10:bob\ndocker:x:998:bob\n"},
+		{"missing", "bob", true, false, "root:x:0:\nwheel:x:10:bob\ndocker:x:998:bob\n"},
+	}
+
+	for _, s := range steps {
+		f, found, err := stageMembers(path, s.group, 3, s.user, s.add)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.commit(); err != nil {
+			t.Fatal(err)
+		}
+		if found != s.found {
+			t.Errorf("%s %s: found = %v, want %v", s.group, s.user, found, s.found)
+		}
+		got, _ := ioutil.ReadFile(path)
+		if string(got) != s.want {
+			t.Errorf("%s %s: file = %q, want %q", s.group, s.user, got, s.want)
+		}
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mode not kept: %v %v", info.Mode(), err)
+	}
+	if info, err := os.Stat(path + "-"); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("backup missing or with the wrong mode: %v %v", info, err)
+	}
+}
+
+func TestStageMembersUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "group")
+	orig := "wheel:x:10:alice\n"
+	if err := ioutil.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A staged file that is discarded, as when the other file fails, leaves
+	// nothing behind.
+	f, _, err := stageMembers(path, "wheel", 3, "bob", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.discard()
+
+	if got, _ := ioutil.ReadFile(path); string(got) != orig {
+		t.Errorf("file changed before commit: %q", got)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary file left behind, %d entries", len(entries))
+	}
+}
+
+func TestCommitAllRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	group := filepath.Join(dir, "group")
+	gshadow := filepath.Join(dir, "gshadow")
+	origGroup := "wheel:x:10:alice\n"
+	if err := ioutil.WriteFile(group, []byte(origGroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(gshadow, []byte("wheel:!::alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	g, _, err := stageMembers(group, "wheel", 3, "bob", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := stageMembers(gshadow, "wheel", 3, "bob", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the second rename fail after the first went through
+	s.discard()
+
+	if err := commitAll([]*stagedFile{g, s}); err == nil {
+		t.Fatal("commitAll did not fail")
+	}
+	if got, _ := ioutil.ReadFile(group); string(got) != origGroup {
+		t.Errorf("group not rolled back: %q", got)
+	}
+	if info, err := os.Stat(group); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mode not kept on rollback: %v %v", info, err)
+	}
+}
+
+func TestGroupNotPrivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("must not be run as root")
+	}
+	err := RemoveUserFromGroup("nobody", "wheel")
+
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Stage != StageGroup {
+		t.Fatalf("expected a group stage *Error, got %T: %v", err, err)
+	}
+	if !errors.Is(err, ErrNotPrivileged) {
+		t.Errorf("errors.Is(%v, ErrNotPrivileged) = false", err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * history.go - Check a new password against the users password history.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+// Package history checks a new password against a users password history,
+// so a UI can turn down a reused password at once rather than after a full
+// run of the password stack. It is kept apart from axiospam as it links to
+// libcrypt (libxcrypt-devel, on Ubuntu libcrypt-dev).
+package history
+
+/*
+#cgo LDFLAGS: -lcrypt
+
+#include <crypt.h>
+#include <errno.h>
+#include <shadow.h>
+#include <stdlib.h>
+#include <string.h>
+*/
+import "C"
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/mjwaxios/axiospam"
+)
+
+// opasswdFile is where pam_pwhistory and pam_unix (remember=N) keep old
+// password hashes.
+var opasswdFile = "/etc/security/opasswd"
+
+// maxShadowBuf caps how far shadowHash grows its buffer for a single entry.
+const maxShadowBuf = 1 << 20
+
+// Contains reports if password matches the users current password or one of
+// the old ones kept in /etc/security/opasswd. Call it before
+// axiospam.ChangePassword. Reading the files needs root, and a missing
+// opasswd file just means there is no history.
+func Contains(name, password string) (bool, error) {
+	var hashes []string
+
+	hash, found, err := shadowHash(name)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		hashes = append(hashes, hash)
+	}
+
+	old, err := readOpasswd(opasswdFile, name)
+	if err != nil {
+		return false, lookupError(err)
+	}
+	hashes = append(hashes, old...)
+
+	for _, h := range hashes {
+		if cryptMatch(password, h) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookupError is the *axiospam.Error for a failed read of the history.
+func lookupError(err error) error {
+	return &axiospam.Error{
+		Code:  axiospam.PamSystemERR,
+		Stage: axiospam.StageLookup,
+		Err:   err,
+	}
+}
+
+// shadowHash reads the users current hash through NSS, found is false if
+// there is no entry we can see.
+func shadowHash(name string) (hash string, found bool, err error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	size := C.size_t(1024)
+
+	spwd := (*C.struct_spwd)(C.malloc(C.sizeof_struct_spwd))
+	defer C.free(unsafe.Pointer(spwd))
+	result := (**C.struct_spwd)(C.malloc(C.size_t(unsafe.Sizeof(spwd))))
+	defer C.free(unsafe.Pointer(result))
+
+	for {
+		buf := C.malloc(size)
+		rc := C.getspnam_r(cName, spwd, (*C.char)(buf), size, result)
+		if rc == 0 && *result != nil {
+			hash = C.GoString((*result).sp_pwdp)
+		}
+		C.free(buf)
+
+		switch {
+		case rc == 0 && *result != nil:
+			return hash, true, nil
+		case rc == C.ERANGE && size*2 <= maxShadowBuf:
+			size *= 2
+			continue
+		case rc == 0, rc == C.ENOENT, rc == C.EACCES, rc == C.EPERM:
+			return "", false, nil
+		}
+		return "", false, lookupError(syscall.Errno(rc))
+	}
+}
+
+// readOpasswd returns the old hashes for the user from an opasswd file, with
+// lines of the form user:uid:count:hash,hash,...
+func readOpasswd(path, name string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 4)
+		if len(fields) != 4 || fields[0] != name || fields[3] == "" {
+			continue
+		}
+		return strings.Split(fields[3], ","), nil
+	}
+
+	return nil, scanner.Err()
+}
+
+// cryptMatch reports if password hashes to hash. Locked ("!...") and empty
+// or disabled ("*", "x") hashes never match.
+func cryptMatch(password, hash string) bool {
+	if len(hash) < 2 || hash[0] == '!' || hash[0] == '*' {
+		return false
+	}
+
+	got, ok := cryptHash(password, hash)
+	return ok && got == hash
+}
+
+// cryptHash runs crypt_r(3), the setting (salt and method) is taken from
+// salt, which may be a full hash.
+func cryptHash(password, salt string) (string, bool) {
+	cPassword := C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(cPassword), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPassword))
+	}()
+	cSalt := C.CString(salt)
+	defer C.free(unsafe.Pointer(cSalt))
+
+	data := (*C.struct_crypt_data)(C.calloc(1, C.sizeof_struct_crypt_data))
+	defer C.free(unsafe.Pointer(data))
+
+	out := C.crypt_r(cPassword, cSalt, data)
+	if out == nil || *out == '*' {
+		return "", false
+	}
+	return C.GoString(out), true
+}
@@ -0,0 +1,60 @@
+/*
+ * history_test.go - Tests for the password history check.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestContains(t *testing.T) {
+	h1, ok := cryptHash("Summer2019!", "$6$abcdefgh$")
+	if !ok {
+		t.Skip("crypt_r does not support SHA-512 here")
+	}
+	h2, _ := cryptHash("Winter2019!", "$6$hgfedcba$")
+
+	f, err := ioutil.TempFile("", "opasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("testana:1000:2:" + h1 + "," + h2 + "\n")
+	f.Close()
+
+	saved := opasswdFile
+	opasswdFile = f.Name()
+	defer func() { opasswdFile = saved }()
+
+	for pass, want := range map[string]bool{
+		"Summer2019!": true,
+		"Winter2019!": true,
+		"Spring2020!": false,
+	} {
+		got, err := Contains("testana", pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Contains(%q) = %v, want %v", pass, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * gss.c - Accept a Kerberos token with GSSAPI.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+#include "gss.h"
+
+#include <gssapi/gssapi.h>
+#include <gssapi/gssapi_ext.h>
+#include <stdlib.h>
+#include <string.h>
+
+// Appends the text for every message of one kind of status code to out.
+static char *appendStatus(char *out, OM_uint32 code, int type) {
+  OM_uint32 minor, ctx = 0;
+  gss_buffer_desc text = GSS_C_EMPTY_BUFFER;
+
+  do {
+    if (GSS_ERROR(gss_display_status(&minor, code, type, GSS_C_NO_OID, &ctx,
+                                     &text))) {
+      break;
+    }
+    size_t used = out ? strlen(out) : 0;
+    char *grown = realloc(out, used + text.length + 3);
+    if (grown != NULL) {
+      out = grown;
+      if (used > 0) {
+        memcpy(out + used, ": ", 2);
+        used += 2;
+      }
+      memcpy(out + used, text.value, text.length);
+      out[used + text.length] = '\0';
+    }
+    gss_release_buffer(&minor, &text);
+  } while (ctx != 0);
+
+  return out;
+}
+
+// The GSS text for a major status, followed by the mechanism text.
+static char *statusText(OM_uint32 major, OM_uint32 minor) {
+  char *out = appendStatus(NULL, major, GSS_C_GSS_CODE);
+  if (minor != 0) {
+    out = appendStatus(out, minor, GSS_C_MECH_CODE);
+  }
+  return out;
+}
+
+OM_uint32 acceptToken(const char *keytab, const void *token, size_t length,
+                      char **principal, char **errmsg) {
+  OM_uint32 major, minor = 0, ignored;
+  gss_key_value_element_desc element = {"keytab", keytab};
+  gss_key_value_set_desc store = {1, &element};
+  gss_cred_id_t cred = GSS_C_NO_CREDENTIAL;
+  gss_ctx_id_t ctx = GSS_C_NO_CONTEXT;
+  gss_name_t client = GSS_C_NO_NAME;
+  gss_buffer_desc input = {length, (void *)token};
+  gss_buffer_desc output = GSS_C_EMPTY_BUFFER;
+  gss_buffer_desc name = GSS_C_EMPTY_BUFFER;
+
+  *principal = NULL;
+  *errmsg = NULL;
+
+  // Only the keytab we are given, never the process default
+  major = gss_acquire_cred_from(&minor, GSS_C_NO_NAME, GSS_C_INDEFINITE,
+                                GSS_C_NO_OID_SET, GSS_C_ACCEPT, &store, &cred,
+                                NULL, NULL);
+  if (major != GSS_S_COMPLETE) {
+    goto out;
+  }
+
+  major = gss_accept_sec_context(&minor, &ctx, cred, &input,
+                                 GSS_C_NO_CHANNEL_BINDINGS, &client, NULL,
+                                 &output, NULL, NULL, NULL);
+  if (major != GSS_S_COMPLETE) {
+    goto out;
+  }
+
+  major = gss_display_name(&minor, client, &name, NULL);
+  if (major == GSS_S_COMPLETE) {
+    *principal = strndup(name.value, name.length);
+  }
+
+out:
+  if (major != GSS_S_COMPLETE) {
+    *errmsg = statusText(major, minor);
+  }
+  gss_release_buffer(&ignored, &name);
+  gss_release_buffer(&ignored, &output);
+  gss_release_name(&ignored, &client);
+  gss_delete_sec_context(&ignored, &ctx, GSS_C_NO_BUFFER);
+  gss_release_cred(&ignored, &cred);
+  return major;
+}
@@ -0,0 +1,33 @@
+/*
+ * gss.h - Accept a Kerberos token with GSSAPI.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+#ifndef AXIOSPAM_GSS_H
+#define AXIOSPAM_GSS_H
+
+#include <gssapi/gssapi.h>
+#include <stddef.h>
+
+// Accepts the initial context token with the keys in keytab and returns the
+// GSS major status. On GSS_S_COMPLETE principal is set to the name of the
+// client, otherwise errmsg is set to the status text. Both are freed with
+// free().
+OM_uint32 acceptToken(const char *keytab, const void *token, size_t length,
+                      char **principal, char **errmsg);
+
+#endif  // AXIOSPAM_GSS_H
@@ -0,0 +1,137 @@
+/*
+ * keytab.go - Authenticate service principals with Kerberos tokens.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+// Package keytab checks machine credentials for backend to backend calls,
+// through the same axiospam.Authenticator interface as PAM, so one service
+// can prove who it is to another without a user password.
+//
+// This links to libgssapi_krb5 (krb5-devel, on Ubuntu libkrb5-dev), which is
+// why it is kept apart from axiospam.
+package keytab
+
+/*
+#cgo LDFLAGS: -lgssapi_krb5
+
+#include <stdlib.h>
+#include "gss.h"
+*/
+import "C"
+
+import (
+	"context"
+	"strings"
+	"unsafe"
+
+	"github.com/mjwaxios/axiospam"
+)
+
+// DefaultKeytab is the host keytab, used when the Authenticator names none.
+const DefaultKeytab = "/etc/krb5.keytab"
+
+// Authenticator is an axiospam.Authenticator for service principals. The
+// calling service gets a ticket for one of our principals from the KDC and
+// sends the initial GSSAPI token (the Kerberos AP-REQ) as req.Token, with its
+// own principal, such as "svc/app@EXAMPLE.COM", as req.User. The token is
+// checked with the keys in Keytab, and must have been made by req.User.
+// req.Password is not used, and no KDC is contacted.
+//
+// Only one round trip is done, the reply token for mutual authentication is
+// not sent back, so callers must not ask for it.
+type Authenticator struct {
+	// Keytab holds the keys for our principals, DefaultKeytab if empty. It
+	// is only ever taken from here, never from the request.
+	Keytab string
+}
+
+// Authenticate will check the callers token with our keytab
+func (a *Authenticator) Authenticate(ctx context.Context, req axiospam.AuthRequest) (axiospam.AuthResult, error) {
+	res := axiospam.AuthResult{User: req.User}
+
+	if err := ctx.Err(); err != nil {
+		res.Result = axiospam.PamSystemERR
+		return res, &axiospam.Error{Code: axiospam.PamSystemERR, Stage: axiospam.StageStart, Err: err}
+	}
+	if req.User == "" || strings.HasPrefix(req.User, "-") {
+		res.Result = axiospam.PamUserUnknown
+		return res, authError(axiospam.PamUserUnknown, "invalid principal name")
+	}
+	if len(req.Token) == 0 {
+		res.Result = axiospam.PamCredInsufficient
+		return res, authError(axiospam.PamCredInsufficient, "no token")
+	}
+
+	keytab := a.Keytab
+	if keytab == "" {
+		keytab = DefaultKeytab
+	}
+	principal, major, msg := acceptToken(keytab, req.Token)
+
+	if major != 0 {
+		res.Result = gssResult(major)
+		return res, authError(res.Result, msg)
+	}
+	if principal != req.User {
+		res.Result = axiospam.PamAuthERR
+		return res, authError(axiospam.PamAuthERR, "token is not for "+req.User)
+	}
+
+	res.Result = axiospam.PamSuccess
+	return res, nil
+}
+
+// authError is the *axiospam.Error for a token that was turned down.
+func authError(code axiospam.PamResult, msg string) error {
+	return &axiospam.Error{Code: code, Stage: axiospam.StageAuthenticate, Message: msg}
+}
+
+// acceptToken runs gss_accept_sec_context on the token, returning the client
+// principal, or the GSS major status and its text.
+func acceptToken(keytab string, token []byte) (string, uint32, string) {
+	cKeytab := C.CString(keytab)
+	defer C.free(unsafe.Pointer(cKeytab))
+	cToken := C.CBytes(token)
+	defer C.free(cToken)
+
+	var principal, errmsg *C.char
+	major := C.acceptToken(cKeytab, cToken, C.size_t(len(token)), &principal, &errmsg)
+	defer C.free(unsafe.Pointer(principal))
+	defer C.free(unsafe.Pointer(errmsg))
+
+	return C.GoString(principal), uint32(major), C.GoString(errmsg)
+}
+
+// GSS routine errors, see RFC 2744.
+const (
+	gssNoCred             = 7 << 16
+	gssCredentialsExpired = 11 << 16
+	gssContextExpired     = 12 << 16
+	gssRoutineErrorMask   = 0xff << 16
+)
+
+// gssResult maps a GSS major status to the closest PamResult.
+func gssResult(major uint32) axiospam.PamResult {
+	switch major & gssRoutineErrorMask {
+	case gssNoCred:
+		// Missing or unreadable keytab
+		return axiospam.PamCredUnavail
+	case gssCredentialsExpired, gssContextExpired:
+		return axiospam.PamCredExpired
+	}
+	return axiospam.PamAuthERR
+}
@@ -0,0 +1,95 @@
+/*
+ * keytab_test.go - Tests for the keytab Authenticator.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package keytab
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjwaxios/axiospam"
+)
+
+func TestAuthenticatorRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var a axiospam.Authenticator = &Authenticator{Keytab: filepath.Join(dir, "missing.keytab")}
+	token := []byte("not a kerberos token")
+
+	tests := []struct {
+		name string
+		req  axiospam.AuthRequest
+		want axiospam.PamResult
+	}{
+		{"no user", axiospam.AuthRequest{Token: token}, axiospam.PamUserUnknown},
+		{"option as user", axiospam.AuthRequest{User: "-t/etc/krb5.keytab", Token: token}, axiospam.PamUserUnknown},
+		{"no token", axiospam.AuthRequest{User: "svc/app@EXAMPLE.COM", Password: "secret"}, axiospam.PamCredInsufficient},
+		{"no keytab", axiospam.AuthRequest{User: "svc/app@EXAMPLE.COM", Token: token}, axiospam.PamCredUnavail},
+	}
+
+	for _, tt := range tests {
+		res, err := a.Authenticate(context.Background(), tt.req)
+		if res.Result != tt.want || !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v (%v), want %v", tt.name, res.Result, err, tt.want)
+		}
+		var perr *axiospam.Error
+		if !errors.As(err, &perr) || perr.Stage != axiospam.StageAuthenticate {
+			t.Errorf("%s: expected an authenticate stage *Error, got %T: %v", tt.name, err, err)
+		}
+	}
+}
+
+func TestAuthenticatorCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a := &Authenticator{}
+	_, err := a.Authenticate(ctx, axiospam.AuthRequest{User: "svc/app@EXAMPLE.COM", Token: []byte{1}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestGSSResult(t *testing.T) {
+	tests := []struct {
+		major uint32
+		want  axiospam.PamResult
+	}{
+		{gssNoCred, axiospam.PamCredUnavail},
+		{gssCredentialsExpired, axiospam.PamCredExpired},
+		{gssContextExpired, axiospam.PamCredExpired},
+		{9 << 16, axiospam.PamAuthERR},  // GSS_S_DEFECTIVE_TOKEN
+		{13 << 16, axiospam.PamAuthERR}, // GSS_S_FAILURE
+		{1, axiospam.PamAuthERR},        // GSS_S_CONTINUE_NEEDED
+	}
+
+	for _, tt := range tests {
+		if got := gssResult(tt.major); got != tt.want {
+			t.Errorf("gssResult(%#x) = %v, want %v", tt.major, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * limit.go - Cap how many PAM transactions run at once.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Each PAM transaction blocked in cgo pins an OS thread, so a burst of logins
+// against a slow stack can use up threads for the rest of the program. The
+// limiter caps how many transactions run at once and queues the rest in
+// arrival order. It is off until SetConcurrencyLimit is called.
+var limit limiter
+
+// SetConcurrencyLimit caps how many PAM transactions may run at the same time.
+// Calls over the cap wait their turn, first come first served, until their
+// context (see WithContext) is done. A limit of 0 or less turns the cap off.
+// Not every module is safe to run from more than one thread, a limit of 1
+// runs their transactions one at a time.
+func SetConcurrencyLimit(n int) {
+	limit.setMax(n)
+}
+
+// limiter is a counting semaphore with a FIFO queue of waiters.
+type limiter struct {
+	mu      sync.Mutex
+	max     int
+	running int
+	waiters list.List // of chan struct{}
+}
+
+// setMax changes the cap and lets in as many waiters as now fit.
+func (l *limiter) setMax(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.max = n
+	l.wake()
+}
+
+// acquire waits for a slot, or for ctx to be done. Every successful acquire
+// must be paired with a release.
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.max <= 0 || (l.running < l.max && l.waiters.Len() == 0) {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		select {
+		case <-ready:
+			// We were handed a slot as we gave up, pass it on.
+			l.running--
+			l.wake()
+		default:
+			l.waiters.Remove(elem)
+		}
+		return ctx.Err()
+	}
+}
+
+// release gives back a slot and hands it to the next waiter.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	l.wake()
+}
+
+// wake moves waiters from the front of the queue into free slots. It must be
+// called with mu held.
+func (l *limiter) wake() {
+	for l.waiters.Len() > 0 && (l.max <= 0 || l.running < l.max) {
+		front := l.waiters.Front()
+		l.waiters.Remove(front)
+		l.running++
+		close(front.Value.(chan struct{}))
+	}
+}
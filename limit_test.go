@@ -0,0 +1,82 @@
+/*
+ * limit_test.go - Tests for the PAM concurrency limiter.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterFIFO(t *testing.T) {
+	var l limiter
+	l.setMax(1)
+
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue three waiters one after the other and check they get in in order.
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			l.acquire(context.Background())
+			order <- i
+			l.release()
+		}()
+		for {
+			l.mu.Lock()
+			n := l.waiters.Len()
+			l.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	l.release()
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("waiter %d got in before waiter %d", got, want)
+		}
+	}
+}
+
+func TestLimiterContext(t *testing.T) {
+	var l limiter
+	l.setMax(1)
+
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquire = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	l.release()
+	if l.running != 0 || l.waiters.Len() != 0 {
+		t.Errorf("limiter not empty: running %d, waiting %d", l.running, l.waiters.Len())
+	}
+}
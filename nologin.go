@@ -0,0 +1,54 @@
+/*
+ * nologin.go - Tell when pam_nologin is keeping users out.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import "strings"
+
+// ErrLoginsDisabled is the Err of the *Error returned, with PamAuthERR, when
+// the account stage refuses a login or password change and tells the user why, which is how pam_nologin keeps
+// users out during a maintenance window. Message is that notice, the text of
+// the nologin file the administrator left for users.
+type ErrLoginsDisabled struct {
+	Message string
+}
+
+// Error will let us use an ErrLoginsDisabled as an Error
+func (e ErrLoginsDisabled) Error() string {
+	if e.Message == "" {
+		return "logins disabled"
+	}
+	return "logins disabled: " + e.Message
+}
+
+// loginsDisabled returns the error for an account stage that refused the
+// login with flags, or nil if it was not refused with a notice. pam_nologin
+// refuses with AUTH_ERR and sends the file as an error message through the
+// conversation, whatever file= names; root is let in and only shown it as
+// info.
+func loginsDisabled(flags PamResult, c *conversation) error {
+	if flags != PamAuthERR && flags != PamPermDenied {
+		return nil
+	}
+	if len(c.notices) == 0 {
+		return nil
+	}
+	notice := strings.TrimSpace(strings.Join(c.notices, "\n"))
+	return causeError(flags, StageAccount, ErrLoginsDisabled{Message: notice})
+}
@@ -0,0 +1,221 @@
+/*
+ * options.go - Optional settings for the package level PAM calls.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"time"
+)
+
+// Option changes how a single call into PAM is made.
+type Option func(*options)
+
+// options holds the settings for one call, built from the defaults and the
+// Options passed by the caller.
+type options struct {
+	ctx          context.Context
+	service      string
+	retry        retryPolicy
+	stack        string
+	classifier   PromptClassifier
+	otp          string
+	pin          string
+	recheck      *PamResult
+	userPrompt   string
+	promptedUser string
+	rhost        string
+	tty          string
+	flags        Flag
+	deviceEvent  func(string)
+	deviceWait   time.Duration
+	deadlineHint bool
+	authtokType  string
+	// messages are the texts the stack sent during the call, for auditing.
+	messages []string
+	// attempt is the try the call is on, for RequestError.
+	attempt int
+}
+
+// newOptions applies the Options on top of the package defaults.
+func newOptions(opts []Option) *options {
+	o := &options{
+		ctx:        context.Background(),
+		service:    DefaultService,
+		retry:      defaultRetry,
+		classifier: DefaultClassifier,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithContext bounds the call by ctx. It is checked while waiting for the
+// concurrency limit and between retries, a transaction already inside libpam
+// runs to the end.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithService picks the PAM service, the file in /etc/pam.d, for the call in
+// place of DefaultService.
+func WithService(service string) Option {
+	return func(o *options) {
+		o.service = service
+	}
+}
+
+// WithRetry sets how many times a transient failure (AUTHTOK_LOCK_BUSY or
+// TRY_AGAIN) is tried before it is returned to the caller. The wait between
+// tries starts at base and doubles up to max, with random jitter added.
+// An attempts value of 1 or less turns retrying off.
+func WithRetry(attempts int, base, max time.Duration) Option {
+	return func(o *options) {
+		o.retry = retryPolicy{
+			attempts: attempts,
+			base:     base,
+			max:      max,
+		}
+	}
+}
+
+// WithInlineStack runs the call against the given PAM stack instead of the
+// service file in /etc/pam.d. The stack is written to a private directory for
+// the length of each transaction and handed to pam_start_confdir, so tests and
+// sandboxes can use stacks like "auth required pam_permit.so" without touching
+// the system config. This needs Linux-PAM 1.4 or newer, with an older libpam
+// the call fails with PamSymbolERR. The service name is the file name in that
+// directory, so it can not hold a "/".
+func WithInlineStack(contents string) Option {
+	return func(o *options) {
+		o.stack = contents
+	}
+}
+
+// WithPromptClassifier sets how conversation prompts are labeled, in place of
+// DefaultClassifier, for stacks with prompts it does not know.
+func WithPromptClassifier(c PromptClassifier) Option {
+	return func(o *options) {
+		o.classifier = c
+	}
+}
+
+// WithOTP gives the one time code to answer PromptOTP prompts with.
+func WithOTP(code string) Option {
+	return func(o *options) {
+		o.otp = code
+	}
+}
+
+// WithPIN gives the PIN to answer PromptPIN prompts with, without it they
+// get the password.
+func WithPIN(pin string) Option {
+	return func(o *options) {
+		o.pin = pin
+	}
+}
+
+// WithAccountRecheck runs the account stage again, in the same transaction,
+// after a successful ChangePassword and stores the fresh account flags in
+// status. This shows if the account went from PamNewAuthTokReqd to clean. If
+// the password was not changed status is left alone.
+func WithAccountRecheck(status *PamResult) Option {
+	return func(o *options) {
+		o.recheck = status
+	}
+}
+
+// WithUserPrompt sets PAM_USER_PROMPT, the text modules use when they ask for
+// the username. A prompt with exactly this text is answered with the name from
+// WithPromptedUser.
+func WithUserPrompt(prompt string) Option {
+	return func(o *options) {
+		o.userPrompt = prompt
+	}
+}
+
+// WithPromptedUser gives the username to answer the stacks username prompt
+// with, when the call is started without a name. This lets kiosk style
+// "username and password" screens go through the stack, where a module may
+// also map the name to a different account.
+func WithPromptedUser(name string) Option {
+	return func(o *options) {
+		o.promptedUser = name
+	}
+}
+
+// WithRHost sets PAM_RHOST, the host the user is connecting from, for modules
+// like pam_access.
+func WithRHost(host string) Option {
+	return func(o *options) {
+		o.rhost = host
+	}
+}
+
+// WithTTY sets PAM_TTY, the terminal the user is on.
+func WithTTY(name string) Option {
+	return func(o *options) {
+		o.tty = name
+	}
+}
+
+// WithFlags adds PAM flags, such as Silent, to the pam_authenticate call.
+// DisallowNullAuthtok is always set.
+func WithFlags(flags Flag) Option {
+	return func(o *options) {
+		o.flags |= flags
+	}
+}
+
+// WithDeviceEvent sets a callback for hardware token messages, such as the
+// pam_u2f "Please touch the device." cue, so a UI can show them while the
+// stack waits on the token. It runs on its own goroutine and does not hold up
+// the stack.
+func WithDeviceEvent(fn func(msg string)) Option {
+	return func(o *options) {
+		o.deviceEvent = fn
+	}
+}
+
+// WithDeviceWait sets how long to wait before answering a prompt that asks
+// the user to insert a token and press ENTER, as pam_u2f does in interactive
+// mode. Only this call waits, though it keeps its SetConcurrencyLimit slot. The
+// wait ends early, failing the call, if the context from WithContext is done.
+func WithDeviceWait(d time.Duration) Option {
+	return func(o *options) {
+		o.deviceWait = d
+	}
+}
+
+// DeadlineEnv is the PAM environment variable set by WithStackTimeoutHint.
+const DeadlineEnv = "AXIOSPAM_DEADLINE"
+
+// WithStackTimeoutHint puts the call's context deadline in the PAM
+// environment as DeadlineEnv, in milliseconds since the epoch, before the
+// stack runs. Modules that make network calls, and commands run by pam_exec,
+// can read it to give up in time rather than outlive the caller. Nothing is
+// set when the context has no deadline.
+func WithStackTimeoutHint() Option {
+	return func(o *options) {
+		o.deadlineHint = true
+	}
+}
@@ -19,8 +19,11 @@
  * the License.
  */
 
+#define _GNU_SOURCE  // RTLD_DEFAULT
+
 #include "pam.h"
 
+#include <dlfcn.h>
 #include <security/pam_appl.h>
 #include <stdio.h>
 #include <stdlib.h>
@@ -46,21 +49,27 @@ static int conversation(int num_msg, const struct pam_message** msg,
   char* callback_resp = NULL;
   int i;
   for (i = 0; i < num_msg; ++i) {
-    callback_msg = (char*)msg[i]->msg;
-
-    // We run our input callback if the style tells us we need data. Otherwise,
-    // we just print the error messages or text info to standard output.
-    switch (msg[i]->msg_style) {
-      case PAM_PROMPT_ECHO_OFF:
-        callback_resp = passphraseInput(callback_msg);
-        break;
-      case PAM_PROMPT_ECHO_ON:
-        callback_resp = userInput(callback_msg);
-        break;
-      case PAM_ERROR_MSG:
-      case PAM_TEXT_INFO:
-        fprintf(stderr, "%s\n", callback_msg);
-        continue;
+    // Never reuse an answer from the last message.
+    callback_resp = NULL;
+
+    if (msg[i]) {
+      callback_msg = msg[i]->msg ? (char*)msg[i]->msg : "";
+
+      // We run our input callback if the style tells us we need data.
+      // Otherwise, we hand the error messages or text info to Go to keep and
+      // print. Any other style (such as PAM_BINARY_PROMPT) is an error.
+      switch (msg[i]->msg_style) {
+        case PAM_PROMPT_ECHO_OFF:
+        case PAM_PROMPT_ECHO_ON:
+          callback_resp = promptInput((uintptr_t)appdata_ptr,
+                                      msg[i]->msg_style, callback_msg);
+          break;
+        case PAM_ERROR_MSG:
+        case PAM_TEXT_INFO:
+          messageOutput((uintptr_t)appdata_ptr, msg[i]->msg_style,
+                        callback_msg);
+          continue;
+      }
     }
 
     if (!callback_resp) {
@@ -80,8 +89,14 @@ static int conversation(int num_msg, const struct pam_message** msg,
   return PAM_SUCCESS;
 }
 
-static const struct pam_conv conv = {conversation, NULL};
-const struct pam_conv* goConv = &conv;
+struct pam_conv* newConv(uintptr_t id) {
+  struct pam_conv* conv = malloc(sizeof *conv);
+  if (conv) {
+    conv->conv = conversation;
+    conv->appdata_ptr = (void*)id;
+  }
+  return conv;
+}
 
 void freeData(pam_handle_t* pamh, void* data, int error_status) { free(data); }
 
@@ -109,3 +124,19 @@ void freeSecret(pam_handle_t* pamh, char* data, int error_status) {
   munlock(data, size);
   free(data);
 }
+
+typedef int (*StartConfdirFunc)(const char* service, const char* user,
+                                const struct pam_conv* conv,
+                                const char* confdir, pam_handle_t** pamh);
+
+int startConfdir(const char* service, const char* user,
+                 const struct pam_conv* conv, const char* confdir,
+                 pam_handle_t** pamh) {
+  // Looked up at run time, so the package still loads with Linux-PAM < 1.4.
+  StartConfdirFunc start =
+      (StartConfdirFunc)dlsym(RTLD_DEFAULT, "pam_start_confdir");
+  if (!start) {
+    return -1;
+  }
+  return start(service, user, conv, confdir, pamh);
+}
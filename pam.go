@@ -22,17 +22,25 @@
 package axiospam
 
 /*
-#cgo LDFLAGS: -lpam
+#cgo LDFLAGS: -lpam -ldl
 #include "pam.h"
 
+#include <errno.h>
 #include <pwd.h>
+#include <shadow.h>
 #include <stdlib.h>
+#include <unistd.h>
 #include <security/pam_modules.h>
 */
 import "C"
 import (
-	"errors"
+	"io/ioutil"
+	"os"
 	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"unsafe"
 )
 
@@ -42,49 +50,190 @@ type handle struct {
 	status C.int
 	// PamUser is the user for whom the PAM module is running.
 	PamUser *user.User
+	// confdir is the private config directory holding an inline stack, it is
+	// removed when the transaction ends.
+	confdir string
+	// conv is the C side of the conversation, its appdata is convID.
+	conv   *C.struct_pam_conv
+	convID uintptr
 }
 
-func (h *handle) err() error {
+// err returns an *Error for the handles status, or nil if it is PAM_SUCCESS.
+func (h *handle) err(stage Stage) error {
 	if h.status == C.PAM_SUCCESS {
 		return nil
 	}
-	s := C.GoString(C.pam_strerror(h.handle, C.int(h.status)))
-	return errors.New(s)
+	return &Error{
+		Code:    PamResult(h.status),
+		Stage:   stage,
+		Message: C.GoString(C.pam_strerror(h.handle, C.int(h.status))),
+	}
+}
+
+// strerror returns the libpam text for a code when there is no handle at
+// hand. Linux-PAM does not look at the handle for this.
+func strerror(code PamResult) string {
+	return C.GoString(C.pam_strerror(nil, C.int(code)))
 }
 
 // Transaction represents a wrapped pam_handle_t type created with pam_start
 // form an application.
 type transaction handle
 
-// Start initializes a pam Transaction. End() should be called after the
-// Transaction is no longer needed.
-func start(service, username string) (*transaction, error) {
+// Start initializes a pam Transaction, with c answering the stack. End()
+// should be called after the Transaction is no longer needed. If stack is not
+// empty it is used as the service file, from a private config directory, in
+// place of /etc/pam.d.
+func start(service, username, stack string, c *conversation) (*transaction, error) {
 	cService := C.CString(service)
 	defer C.free(unsafe.Pointer(cService))
-	cUsername := C.CString(username)
-	defer C.free(unsafe.Pointer(cUsername))
+	// With no username the stack asks for one through the conversation.
+	var cUsername *C.char
+	if username != "" {
+		cUsername = C.CString(username)
+		defer C.free(unsafe.Pointer(cUsername))
+	}
 
 	t := &transaction{
 		handle: nil,
 		status: C.PAM_SUCCESS,
 	}
-	t.status = C.pam_start(
+
+	t.convID = addConversation(c)
+	t.conv = C.newConv(C.uintptr_t(t.convID))
+	if t.conv == nil {
+		t.release()
+		t.status = C.PAM_BUF_ERR
+		return t, (*handle)(t).err(StageStart)
+	}
+
+	if stack == "" {
+		t.status = C.pam_start(
+			cService,
+			cUsername,
+			t.conv,
+			&t.handle)
+		if err := (*handle)(t).err(StageStart); err != nil {
+			t.release()
+			return t, err
+		}
+		return t, nil
+	}
+
+	confdir, err := writeStack(service, stack)
+	if err != nil {
+		t.release()
+		return t, err
+	}
+	cConfdir := C.CString(confdir)
+	defer C.free(unsafe.Pointer(cConfdir))
+
+	t.status = C.startConfdir(
 		cService,
 		cUsername,
-		C.goConv,
+		t.conv,
+		cConfdir,
 		&t.handle)
-	return t, (*handle)(t).err()
+	if t.status == -1 {
+		os.RemoveAll(confdir)
+		t.release()
+		t.status = C.PAM_SYMBOL_ERR
+		return t, &Error{
+			Code:    PamSymbolERR,
+			Stage:   StageStart,
+			Message: "inline stacks need pam_start_confdir, Linux-PAM 1.4 or newer",
+		}
+	}
+	if err := (*handle)(t).err(StageStart); err != nil {
+		os.RemoveAll(confdir)
+		t.release()
+		return t, err
+	}
+	t.confdir = confdir
+	return t, nil
+}
+
+// writeStack puts the stack in a new private directory as the service file.
+// The service name is used as the file name, so it can not be a path.
+func writeStack(service, stack string) (string, error) {
+	if service == "" || service == "." || service == ".." || strings.ContainsRune(service, '/') {
+		return "", &Error{
+			Code:    PamServiceERR,
+			Stage:   StageStart,
+			Message: "invalid service name " + strconv.Quote(service),
+		}
+	}
+
+	confdir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		return "", causeError(PamSystemERR, StageStart, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(confdir, service), []byte(stack), 0600)
+	if err != nil {
+		os.RemoveAll(confdir)
+		return "", causeError(PamSystemERR, StageStart, err)
+	}
+	return confdir, nil
 }
 
 // End finalizes a pam Transaction with pam_end().
 func (t *transaction) End() {
 	C.pam_end(t.handle, t.status)
+	if t.confdir != "" {
+		os.RemoveAll(t.confdir)
+	}
+	t.release()
+}
+
+// release drops the conversation, once libpam can no longer call it.
+func (t *transaction) release() {
+	if t.conv != nil {
+		C.free(unsafe.Pointer(t.conv))
+		t.conv = nil
+	}
+	if t.convID != 0 {
+		removeConversation(t.convID)
+		t.convID = 0
+	}
+}
+
+// setItem sets a string PAM item, such as the user prompt, on the transaction.
+func (t *transaction) setItem(i item, value string) error {
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+
+	t.status = C.pam_set_item(t.handle, C.int(i), unsafe.Pointer(cValue))
+	return (*handle)(t).err(StageStart)
+}
+
+// putenv sets a variable in the PAM environment, where modules read it with
+// pam_getenv and pam_exec passes it on to its command.
+func (t *transaction) putenv(name, value string) error {
+	cNameValue := C.CString(name + "=" + value)
+	defer C.free(unsafe.Pointer(cNameValue))
+
+	t.status = C.pam_putenv(t.handle, cNameValue)
+	return (*handle)(t).err(StageStart)
+}
+
+// getItem returns a string PAM item, such as the user the stack settled on.
+func (t *transaction) getItem(i item) (string, error) {
+	var value unsafe.Pointer
+	status := C.pam_get_item(t.handle, C.int(i), &value)
+	if status != C.PAM_SUCCESS {
+		return "", newError(PamResult(status), StageAuthenticate)
+	}
+	if value == nil {
+		return "", nil
+	}
+	return C.GoString((*C.char)(value)), nil
 }
 
 // authenticate returns a boolean indicating if the user authenticated correctly
 // or not. If the authentication check did not complete, an error is returned.
-func (t *transaction) authenticate(quiet bool) (bool, error) {
-	var flags C.int = C.PAM_DISALLOW_NULL_AUTHTOK
+// Any extra flags are passed on to pam_authenticate.
+func (t *transaction) authenticate(quiet bool, extra Flag) (bool, error) {
+	var flags C.int = C.PAM_DISALLOW_NULL_AUTHTOK | C.int(extra)
 	if quiet {
 		flags |= C.PAM_SILENT
 	}
@@ -92,7 +241,7 @@ func (t *transaction) authenticate(quiet bool) (bool, error) {
 	if t.status == C.PAM_AUTH_ERR {
 		return false, nil
 	}
-	return true, (*handle)(t).err()
+	return true, (*handle)(t).err(StageAuthenticate)
 }
 
 // changeTok changes the user password
@@ -107,11 +256,11 @@ func (t *transaction) changeTok(quiet bool) (int, error) {
 	switch t.status {
 	case C.PAM_SUCCESS:
 		return 0, nil
-	case C.PAM_AUTHTOK_ERR:
-		return 20, nil
+	case C.PAM_AUTHTOK_ERR, C.PAM_AUTHTOK_LOCK_BUSY, C.PAM_TRY_AGAIN:
+		return int(t.status), nil
 	}
 
-	return -1, (*handle)(t).err()
+	return -1, (*handle)(t).err(StageChangeTok)
 }
 
 func (t *transaction) accountManagement(quiet bool) (int, error) {
@@ -123,3 +272,97 @@ func (t *transaction) accountManagement(quiet bool) (int, error) {
 
 	return int(t.status), nil
 }
+
+// maxPasswdBuf caps how far lookupUser grows its buffer for a single entry.
+const maxPasswdBuf = 1 << 20
+
+// lookupUser asks the passwd database, through NSS, if the user exists. This
+// sees LDAP and SSSD users the same as local ones, and does not touch PAM.
+func lookupUser(username string) (bool, error) {
+	// No name is no user, getpwnam_r is never handed a NULL or empty name.
+	if username == "" {
+		return false, nil
+	}
+
+	cUsername := C.CString(username)
+	defer C.free(unsafe.Pointer(cUsername))
+
+	size := C.long(C.sysconf(C._SC_GETPW_R_SIZE_MAX))
+	if size <= 0 {
+		size = 1024
+	}
+
+	// Everything handed to getpwnam_r lives in C memory, since it fills in
+	// pointers to the buffer and to the passwd struct.
+	pwd := (*C.struct_passwd)(C.malloc(C.sizeof_struct_passwd))
+	defer C.free(unsafe.Pointer(pwd))
+	result := (**C.struct_passwd)(C.malloc(C.size_t(unsafe.Sizeof(pwd))))
+	defer C.free(unsafe.Pointer(result))
+
+	for {
+		buf := C.malloc(C.size_t(size))
+		rc := C.getpwnam_r(cUsername, pwd, (*C.char)(buf), C.size_t(size), result)
+		C.free(buf)
+
+		switch rc {
+		case 0, C.ENOENT, C.ESRCH, C.EBADF, C.EPERM:
+			// getpwnam_r(3) lists these as "name not found"
+			return *result != nil, nil
+		case C.ERANGE:
+			if size *= 2; size <= maxPasswdBuf {
+				continue
+			}
+		}
+		return false, causeError(PamSystemERR, StageLookup, syscall.Errno(rc))
+	}
+}
+
+// shadowEntry is the part of a shadow entry needed to watch an account.
+type shadowEntry struct {
+	hash       string
+	lastChange int64 // days since the epoch
+	max        int64 // days a password is good for, -1 for no limit
+	expire     int64 // days since the epoch, -1 for never
+}
+
+// lookupShadow reads the users shadow entry through NSS. This normally needs
+// root, found is false if there is no entry we can see.
+func lookupShadow(username string) (entry shadowEntry, found bool, err error) {
+	cUsername := C.CString(username)
+	defer C.free(unsafe.Pointer(cUsername))
+
+	size := C.long(1024)
+
+	spwd := (*C.struct_spwd)(C.malloc(C.sizeof_struct_spwd))
+	defer C.free(unsafe.Pointer(spwd))
+	result := (**C.struct_spwd)(C.malloc(C.size_t(unsafe.Sizeof(spwd))))
+	defer C.free(unsafe.Pointer(result))
+
+	for {
+		buf := C.malloc(C.size_t(size))
+		rc := C.getspnam_r(cUsername, spwd, (*C.char)(buf), C.size_t(size), result)
+
+		switch {
+		case rc == 0 && *result != nil:
+			entry = shadowEntry{
+				hash:       C.GoString((*result).sp_pwdp),
+				lastChange: int64((*result).sp_lstchg),
+				max:        int64((*result).sp_max),
+				expire:     int64((*result).sp_expire),
+			}
+			C.free(buf)
+			return entry, true, nil
+		case rc == C.ERANGE && size*2 <= maxPasswdBuf:
+			C.free(buf)
+			size *= 2
+			continue
+		}
+		C.free(buf)
+
+		switch rc {
+		case 0, C.ENOENT, C.EACCES, C.EPERM:
+			return entry, false, nil
+		}
+		return entry, false, causeError(PamSystemERR, StageLookup, syscall.Errno(rc))
+	}
+}
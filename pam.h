@@ -23,9 +23,12 @@
 #define FSCRYPT_PAM_H
 
 #include <security/pam_appl.h>
+#include <stdint.h>
 
-// Conversation that will call back into Go code when appropriate.
-extern const struct pam_conv *goConv;
+// Makes a conversation that will call back into Go code when appropriate,
+// passing id so Go can find the transaction it belongs to. Free it with free()
+// once the transaction has ended.
+struct pam_conv *newConv(uintptr_t id);
 
 // CleaupFuncs are used to cleanup specific PAM data.
 typedef void (*CleanupFunc)(pam_handle_t *pamh, void *data, int error_status);
@@ -43,4 +46,10 @@ void *copyIntoSecret(void *data);
 // CleaupFunc that Zeros wipes a C string and unlocks and frees its memory.
 void freeSecret(pam_handle_t *pamh, char *data, int error_status);
 
+// Calls pam_start_confdir if libpam has it (Linux-PAM 1.4 and newer), and
+// returns -1 if it does not.
+int startConfdir(const char *service, const char *user,
+                 const struct pam_conv *conv, const char *confdir,
+                 pam_handle_t **pamh);
+
 #endif  // FSCRYPT_PAM_H
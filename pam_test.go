@@ -22,3 +22,25 @@ package axiospam
 import "testing"
 
 func TestTrivial(t *testing.T) {}
+
+func TestUserExists(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"root", true},
+		{"", false},
+		{"no-such-user-axiospam", false},
+	}
+
+	for _, tt := range tests {
+		got, err := UserExists(tt.name)
+		if err != nil {
+			t.Errorf("UserExists(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("UserExists(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
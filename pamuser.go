@@ -36,18 +36,40 @@
 //
 // This also links to libpam so you will need to have libpam-devel installed.
 // on Ubuntu the pam-devel package is called libpam0g-dev
+// The password history check, in the history package, also links to libcrypt
+// (libxcrypt-devel, on Ubuntu libcrypt-dev).
+//
+// The conversation with the stack has fixed limits. Prompts and messages are
+// cut to PAM_MAX_MSG_SIZE (512) bytes, only the first maxMessages messages of
+// a transaction are kept, and an answer of PAM_MAX_RESP_SIZE (512) bytes or
+// more, or with a NUL in it, fails the conversation rather than being cut.
+// Messages of an unknown style fail the conversation.
 package axiospam
 
+/*
+#include <security/pam_appl.h>
+#include <stdint.h>
+#include <string.h>
+*/
 import "C"
 
 import (
+	"context"
 	"errors"
-	//	"fmt"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// DefaultService is the PAM service, the file in /etc/pam.d, used when a call
+// or PAMUser does not pick one.
+var DefaultService = "axiospam"
+
 var (
-	errUnknownFlag = errors.New("unknown flag on account")
+	errNotRun = errors.New("Authenticate not run yet")
 )
 
 // PamResult is the result of a call to Authenticate
@@ -126,7 +148,7 @@ var messages = [...]string{
 
 // String will convert a PamResult to a String
 func (s PamResult) String() string {
-	if int(s) < 0 || int(s) > len(messages) {
+	if int(s) < 0 || int(s) >= len(messages) {
 		return "unknown AuthenResult"
 	}
 
@@ -139,201 +161,634 @@ func (s PamResult) Error() string {
 }
 
 // AccountFlags get the User Account Flags from Pam
-func AccountFlags(name string) (PamResult, error) {
-	flags, err := getUserAccountFlags(name, true)
-	return flags, err
+func AccountFlags(name string, opts ...Option) (PamResult, error) {
+	o := newOptions(opts)
+	flags, err := getUserAccountFlags(o, name, true)
+	return flags, requestError(o, name, err)
 }
 
-// Authenticate takes the username and password and checks it with PAM
-func Authenticate(name, password string) (PamResult, error) {
-	// Check that we can get the Account Info for this user,
-	// we will also check the flags again after we authenticate
-	Flags, _ := getUserAccountFlags(name, true)
+// UserExists reports if the system knows about the user. It looks the name up
+// through NSS, so LDAP and SSSD users count, without starting a PAM
+// transaction or running the account stage.
+func UserExists(name string) (bool, error) {
+	return lookupUser(name)
+}
 
-	switch Flags {
-	case PamSuccess, PamNewAuthTokReqd, PamAuthTokExpired:
-		break
-	case PamAuthInfoUnavail, PamUserUnknown, PamAcctExpired:
-		return PamAuthERR, Flags
-	default:
-		return PamSystemERR, errUnknownFlag
+// Authenticate takes the username and password and checks it with PAM.
+// If name is empty the stack is started without a user and asks for one, see
+// WithPromptedUser.
+func Authenticate(name, password string, opts ...Option) (PamResult, error) {
+	o := newOptions(opts)
+	r, err := authenticateRequest(o, AuthRequest{User: name, Password: password})
+	return r.Result, err
+}
+
+// authenticate is Authenticate after the options are set up, it also returns
+// the user the stack settled on.
+func authenticate(o *options, name, password string) (PamResult, string, error) {
+	// Check that we can get the Account Info for this user,
+	// we will also check the flags again after we authenticate.
+	// With no name yet there is no account to check.
+	if name != "" {
+		Flags, err := getUserAccountFlags(o, name, true)
+
+		// Refused by the account stage for a maintenance window
+		if errors.As(err, new(ErrLoginsDisabled)) {
+			return PamAuthERR, name, err
+		}
+
+		switch Flags {
+		case PamSuccess, PamNewAuthTokReqd, PamAuthTokExpired:
+			break
+		case PamAuthInfoUnavail, PamUserUnknown, PamAcctExpired:
+			return PamAuthERR, name, newError(Flags, StageAccount)
+		default:
+			return PamSystemERR, name, accountError(Flags, err)
+		}
 	}
 
-	a, err := isUserLoginToken(name, password, false)
+	a, user, err := isUserLoginToken(o, name, password, false)
 	if err != nil {
-		return PamSystemERR, err
+		return PamSystemERR, name, err
+	}
+	if user != "" {
+		name = user
+	}
+
+	// Too many failures, tell the caller when they can try again
+	if a == PamMaxTries {
+		return PamMaxTries, name, lockedOut(name, StageAuthenticate)
 	}
 
 	// Did not Authenticate and did not have an error
 	// We return an AuthERR and the result from the pam call might have more information
 	if a != PamSuccess {
-		return PamAuthERR, a
+		return PamAuthERR, name, newError(a, StageAuthenticate)
 	}
 
 	// We are Authenticated from this point on
 
 	// We Are Valid, so check if we should return any flags for the account
-	Flags, _ = getUserAccountFlags(name, true)
+	Flags, err := getUserAccountFlags(o, name, true)
+	if errors.As(err, new(ErrLoginsDisabled)) {
+		return PamAuthERR, name, err
+	}
 
 	switch Flags {
 	case PamSuccess, PamNewAuthTokReqd, PamAcctExpired:
-		return Flags, nil
+		return Flags, name, nil
 	}
 
-	return PamSystemERR, errUnknownFlag
+	return PamSystemERR, name, accountError(Flags, err)
+}
+
+// ChangePassword will call the pam system to change the users password.
+// A password change that fails with AUTHTOK_LOCK_BUSY or TRY_AGAIN is retried,
+// see WithRetry.
+func ChangePassword(name, oldPassword, newPassword string, opts ...Option) (PamResult, error) {
+	o := newOptions(opts)
+	r, err := changePassword(o, name, oldPassword, newPassword)
+	audit(o, OpChangeTok, name, r, err)
+	return r, requestError(o, name, err)
 }
 
-// ChangePassword will call the pam system to change the users password
-func ChangePassword(name, oldPassword, newPassword string) (PamResult, error) {
+// ChangeAuthTok changes a token other than the UNIX password, such as a
+// smartcard PIN with pam_pkcs11 or the secret of an OTP module. tokType is
+// set as PAM_AUTHTOK_TYPE, which modules put in their prompts ("New PIN: ")
+// in place of "password". Prompts the classifier labels with the same kind of
+// token get the old token, so OTP or PIN prompts are answered with oldTok
+// unless WithOTP or WithPIN are given.
+func ChangeAuthTok(name, tokType, oldTok, newTok string, opts ...Option) (PamResult, error) {
+	o := newOptions(opts)
+	o.authtokType = tokType
+	r, err := changePassword(o, name, oldTok, newTok)
+	audit(o, OpChangeTok, name, r, err)
+	return r, requestError(o, name, err)
+}
+
+// ChangePIN changes a smartcard or token PIN, it is ChangeAuthTok with a
+// type of "PIN".
+func ChangePIN(name, oldPIN, newPIN string, opts ...Option) (PamResult, error) {
+	return ChangeAuthTok(name, "PIN", oldPIN, newPIN, opts...)
+}
+
+// changePassword is ChangePassword after the options are set up.
+func changePassword(o *options, name, oldPassword, newPassword string) (PamResult, error) {
 	// Check that we can get the Account Info for this user,
-	Flags, _ := getUserAccountFlags(name, true)
+	Flags, err := getUserAccountFlags(o, name, true)
+	if errors.As(err, new(ErrLoginsDisabled)) {
+		return PamAuthERR, err
+	}
 
 	switch Flags {
 	case PamSuccess, PamNewAuthTokReqd, PamAcctExpired:
 		break
 	case PamUserUnknown, PamAuthInfoUnavail:
-		return PamAuthERR, Flags
+		return PamAuthERR, newError(Flags, StageAccount)
 	default:
-		return PamSystemERR, errUnknownFlag
+		return PamSystemERR, accountError(Flags, err)
 	}
 
-	// Continue to Change Password
-	status, err := changeToken(name, oldPassword, newPassword, false)
-	if err != nil {
-		return PamSystemERR, err
+	// Continue to Change Password, giving transient failures a few more tries
+	var status PamResult
+	for attempt := 1; ; attempt++ {
+		o.attempt = attempt
+		var err error
+		status, err = changeToken(o, name, oldPassword, newPassword, false)
+		if err != nil {
+			return PamSystemERR, err
+		}
+
+		if !o.retry.retryable(status) || attempt >= o.retry.attempts {
+			break
+		}
+		select {
+		case <-time.After(o.retry.backoff(attempt)):
+		case <-o.ctx.Done():
+			return PamSystemERR, causeError(PamSystemERR, StageChangeTok, o.ctx.Err())
+		}
 	}
 
 	switch status {
 	case PamSuccess:
 		return PamSuccess, nil
-	case PamAuthERR, PamAuthTokERR:
-		return status, status
+	case PamMaxTries:
+		return PamMaxTries, lockedOut(name, StageAuthenticate)
+	case PamAuthERR:
+		return status, newError(status, StageAuthenticate)
+	case PamAuthTokERR, PamAuthTokLockBusy, PamTryAgain:
+		return status, newError(status, StageChangeTok)
 	}
 
-	return PamSystemERR, errUnknownFlag
+	return PamSystemERR, newError(status, StageChangeTok)
+}
+
+// accountError is the error for account flags we do not expect, keeping the
+// error from the transaction if there was one.
+func accountError(flags PamResult, err error) error {
+	if err != nil {
+		return err
+	}
+	return newError(flags, StageAccount)
+}
+
+// PAMUser is a single user checked against PAM. Each PAMUser can carry its own
+// service, so one process can use different stacks for different operations.
+type PAMUser struct {
+	Username string
+	password string
+	service  string
+	result   PamResult
+	err      error
+}
+
+// New makes a PAMUser that uses DefaultService until SetService is called.
+func New(username, password string) *PAMUser {
+	return &PAMUser{
+		Username: username,
+		password: password,
+		result:   PamAuthERR,
+		err:      errNotRun,
+	}
+}
+
+// SetPassword changes the password to check, the user must Authenticate again.
+func (p *PAMUser) SetPassword(password string) {
+	p.password = password
+	p.result = PamAuthERR
+	p.err = errNotRun
+}
+
+// SetService sets the PAM service for this user, an empty service goes back to
+// DefaultService. The user must Authenticate again.
+func (p *PAMUser) SetService(service string) {
+	p.service = service
+	p.result = PamAuthERR
+	p.err = errNotRun
+}
+
+// Service returns the PAM service this user is checked against.
+func (p *PAMUser) Service() string {
+	if p.service == "" {
+		return DefaultService
+	}
+	return p.service
+}
+
+// Authenticate checks the users password with PAM and remembers the result.
+// If Username is empty the stack asks for it (see WithPromptedUser) and
+// Username is set to the user the stack settled on.
+func (p *PAMUser) Authenticate(opts ...Option) (bool, error) {
+	var user string
+	o := newOptions(p.options(opts))
+	p.result, user, p.err = authenticate(o, p.Username, p.password)
+	if p.Username == "" {
+		p.Username = user
+	}
+	audit(o, OpAuthenticate, p.Username, p.result, p.err)
+	firstLogin(p.Username, p.err)
+	p.err = requestError(o, p.Username, p.err)
+	return p.IsAuthenticated()
+}
+
+// IsAuthenticated returns the result of the last Authenticate.
+func (p *PAMUser) IsAuthenticated() (bool, error) {
+	return p.err == nil, p.err
+}
+
+// Result returns the PamResult of the last Authenticate, this holds the
+// account flags such as PamNewAuthTokReqd when the user authenticated.
+func (p *PAMUser) Result() PamResult {
+	return p.result
+}
+
+// AccountFlags get the User Account Flags from Pam for this user
+func (p *PAMUser) AccountFlags(opts ...Option) (PamResult, error) {
+	return AccountFlags(p.Username, p.options(opts)...)
+}
+
+// ChangePassword changes the users password, and on success the new password
+// is the one used from then on.
+func (p *PAMUser) ChangePassword(newPassword string, opts ...Option) (PamResult, error) {
+	r, err := ChangePassword(p.Username, p.password, newPassword, p.options(opts)...)
+	if err == nil {
+		p.SetPassword(newPassword)
+	}
+	return r, err
+}
+
+// options puts this users service in front of the callers Options, so the
+// caller can still override it for one call.
+func (p *PAMUser) options(opts []Option) []Option {
+	if p.service == "" {
+		return opts
+	}
+	return append([]Option{WithService(p.service)}, opts...)
 }
 
 // ------------------------------------------------------------------------------------
 // Private Functtions to call the pam C interface
 // ------------------------------------------------------------------------------------
 
-// Global state is needed for the PAM callback, so we guard this function with a
-// lock. tokenToCheck is only ever non-nil when tokenLock is held.
+// The conversation for each open transaction, by the id libpam hands back to
+// the callbacks as appdata_ptr.
 var (
-	tokenLock    sync.Mutex
-	tokenToCheck string
-	tokenToSet   string
+	convLock sync.Mutex
+	convs    = map[uintptr]*conversation{}
+	convNext uintptr
 )
 
-// userInput is run when the callback needs some input from the user. We prompt
-// the user for information and return their answer. A return value of nil
-// indicates an error occurred.
-//export userInput
-func userInput(prompt *C.char) *C.char {
-	//	s := C.GoString(prompt)
-	//	if s != "" {
-	//		fmt.Println(s)
-	//	}
-	return C.CString("")
+// addConversation registers c and returns its id, which is never 0.
+func addConversation(c *conversation) uintptr {
+	convLock.Lock()
+	defer convLock.Unlock()
+
+	convNext++
+	convs[convNext] = c
+	return convNext
+}
+
+// removeConversation drops the conversation with the id.
+func removeConversation(id uintptr) {
+	convLock.Lock()
+	defer convLock.Unlock()
+
+	delete(convs, id)
 }
 
-// passphraseInput is run when the callback needs a passphrase from the user. We
-// pass along the tokenToCheck without prompting. A return value of nil
+// lookupConversation returns the conversation with the id, or nil.
+func lookupConversation(id uintptr) *conversation {
+	convLock.Lock()
+	defer convLock.Unlock()
+
+	return convs[id]
+}
+
+// conversation holds the secrets for one transaction and answers the prompts
+// from the PAM stack with them.
+type conversation struct {
+	classifier  PromptClassifier
+	username    string
+	userPrompt  string
+	password    string
+	newPassword string
+	otp         string
+	pin         string
+	// unknownSent counts hidden prompts that could not be classified, the
+	// first gets the password and the rest the new password.
+	unknownSent int
+	// messages are the error and info texts sent by the stack, notices are
+	// the error ones.
+	messages []string
+	notices  []string
+	// deviceEvent and deviceWait handle hardware token prompts.
+	deviceEvent func(string)
+	deviceWait  time.Duration
+	// ctx is the calls context, cancelled is set when it was done while
+	// we waited, so the conversation fails.
+	ctx       context.Context
+	cancelled bool
+}
+
+// newConversation makes the conversation for one transaction.
+func newConversation(o *options, password, newPassword string) *conversation {
+	c := &conversation{
+		classifier:  o.classifier,
+		username:    o.promptedUser,
+		userPrompt:  o.userPrompt,
+		password:    password,
+		newPassword: newPassword,
+		otp:         o.otp,
+		pin:         o.pin,
+		deviceEvent: o.deviceEvent,
+		deviceWait:  o.deviceWait,
+		ctx:         o.ctx,
+	}
+
+	// Changing a PIN or OTP secret, the old one answers prompts for it
+	switch strings.ToUpper(o.authtokType) {
+	case "PIN":
+		if c.pin == "" {
+			c.pin = password
+		}
+	case "OTP":
+		if c.otp == "" {
+			c.otp = password
+		}
+	}
+
+	return c
+}
+
+// respond picks the answer for a prompt.
+func (c *conversation) respond(style MessageStyle, prompt string) string {
+	// Our own user prompt is always the stack asking for the username
+	if c.userPrompt != "" && prompt == c.userPrompt {
+		return c.username
+	}
+
+	switch c.classifier.Classify(style, prompt) {
+	case PromptUsername:
+		return c.username
+	case PromptPassword:
+		return c.password
+	case PromptNewPassword:
+		return c.newPassword
+	case PromptOTP:
+		return c.otp
+	case PromptPIN:
+		if c.pin == "" {
+			return c.password
+		}
+		return c.pin
+	case PromptDevice:
+		// Let the UI tell the user, give them time, then carry on
+		c.device(prompt)
+		c.wait(c.deviceWait)
+		return ""
+	}
+
+	// Not something we know, so keep to the order the stack usually asks in
+	if style != PromptEchoOff {
+		return ""
+	}
+	c.unknownSent++
+	if c.unknownSent == 1 {
+		return c.password
+	}
+	return c.newPassword
+}
+
+// wait sleeps for d, or until the calls context is done, so a cancelled call
+// stops at once.
+func (c *conversation) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.ctx.Done():
+		c.cancelled = true
+	}
+}
+
+// message keeps an error or info text, and passes hardware token ones on
+// to the device callback.
+func (c *conversation) message(style MessageStyle, msg string) {
+	if len(c.messages) < maxMessages {
+		c.messages = append(c.messages, msg)
+		if style == ErrorMsg {
+			c.notices = append(c.notices, msg)
+		}
+	}
+	if c.classifier.Classify(style, msg) == PromptDevice {
+		c.device(msg)
+	}
+}
+
+// device runs the device callback without blocking the stack, which is
+// usually waiting on the token itself.
+func (c *conversation) device(msg string) {
+	if c.deviceEvent != nil {
+		go c.deviceEvent(msg)
+	}
+}
+
+// maxMessages is how many error and info messages one transaction keeps, a
+// stack that sends more has the rest printed but not kept.
+const maxMessages = 100
+
+// promptInput is run when the callback needs some input from the user. The
+// conversation picks the answer from the prompt text. A return value of nil
 // indicates an error occurred.
-//export passphraseInput
-func passphraseInput(prompt *C.char) *C.char {
-	//	s := C.GoString(prompt)
-	//	if s != "" {
-	//		fmt.Print(s)
-	//	}
-	// Subsequent calls to passphrase input should fail
-	//	fmt.Println(tokenToCheck)
-	input := (*C.char)(C.CString(tokenToCheck))
-	tokenToCheck = tokenToSet
+//
+//export promptInput
+func promptInput(id C.uintptr_t, style C.int, prompt *C.char) *C.char {
+	conv := lookupConversation(uintptr(id))
+	if conv == nil {
+		return nil
+	}
+	resp := conv.respond(MessageStyle(style), convString(prompt))
+	if conv.cancelled {
+		return nil
+	}
+	if len(resp) >= C.PAM_MAX_RESP_SIZE || strings.IndexByte(resp, 0) >= 0 {
+		return nil
+	}
+	return C.CString(resp)
+}
+
+// messageOutput is run when the stack sends an error or info message. We keep
+// it for the caller and print it to standard error.
+//
+//export messageOutput
+func messageOutput(id C.uintptr_t, style C.int, msg *C.char) {
+	s := convString(msg)
+	if conv := lookupConversation(uintptr(id)); conv != nil {
+		conv.message(MessageStyle(style), s)
+	}
+	fmt.Fprintln(os.Stderr, s)
+}
+
+// convString copies a prompt or message from the stack, reading no more than
+// PAM_MAX_MSG_SIZE bytes of it.
+func convString(s *C.char) string {
+	if s == nil {
+		return ""
+	}
+	return C.GoStringN(s, C.int(C.strnlen(s, C.PAM_MAX_MSG_SIZE)))
+}
+
+// begin starts a transaction for the user and sets the items from the options
+// on it. End() should be called after the transaction is no longer needed.
+func begin(o *options, username string, c *conversation) (*transaction, error) {
+	transaction, err := start(o.service, username, o.stack, c)
+	if err != nil {
+		return transaction, err
+	}
 
-	return input
+	items := []struct {
+		item  item
+		value string
+	}{
+		{rhost, o.rhost},
+		{tty, o.tty},
+		{userPrompt, o.userPrompt},
+		{authtokType, o.authtokType},
+	}
+	for _, i := range items {
+		if i.value == "" {
+			continue
+		}
+		if err := transaction.setItem(i.item, i.value); err != nil {
+			transaction.End()
+			return transaction, err
+		}
+	}
+
+	if deadline, ok := o.ctx.Deadline(); ok && o.deadlineHint {
+		ms := deadline.UnixNano() / int64(time.Millisecond)
+		if err := transaction.putenv(DeadlineEnv, strconv.FormatInt(ms, 10)); err != nil {
+			transaction.End()
+			return transaction, err
+		}
+	}
+
+	return transaction, nil
 }
 
 // IsUserLoginToken returns nil if the presented token is the user's login key,
 // and returns an error otherwise. Note that unless we are currently running as
-// root, this check will only work for the user running this process.
-func isUserLoginToken(username string, password string, quiet bool) (PamResult, error) {
-	// We require global state for the function. This function never takes
-	// ownership of the token, so it is not responsible for wiping it.
-	tokenLock.Lock()
-	tokenToCheck = password
-	tokenToSet = ""
-	defer func() {
-		tokenToCheck = ""
-		tokenToSet = ""
-		tokenLock.Unlock()
-	}()
-
-	transaction, err := start("axiospam", username)
+// root, this check will only work for the user running this process. On
+// success it also returns the user the stack settled on, which may have been
+// asked for or mapped by a module.
+func isUserLoginToken(o *options, username string, password string, quiet bool) (PamResult, string, error) {
+	// This function never takes ownership of the token, so it is not
+	// responsible for wiping it.
+	if err := limit.acquire(o.ctx); err != nil {
+		return PamSystemERR, "", causeError(PamSystemERR, StageStart, err)
+	}
+	defer limit.release()
+
+	conv := newConversation(o, password, "")
+	defer func() { o.messages = append(o.messages, conv.messages...) }()
+
+	transaction, err := begin(o, username, conv)
 	if err != nil {
-		return PamSystemERR, err
+		return PamSystemERR, "", err
 	}
 	defer transaction.End()
 
 	// Ask PAM to authenticate the token.
-	authenticated, err := transaction.authenticate(quiet)
+	authenticated, err := transaction.authenticate(quiet, o.flags)
+	if PamResult(transaction.status) == PamMaxTries {
+		return PamMaxTries, "", nil
+	}
 	if err != nil {
-		return PamSystemERR, err
+		return PamSystemERR, "", err
 	}
 
-	if authenticated {
-		return PamSuccess, nil
+	if !authenticated {
+		return PamAuthERR, "", nil
 	}
 
-	return PamAuthERR, nil
+	user, err := transaction.getItem(userc)
+	if err != nil {
+		return PamSystemERR, "", err
+	}
+
+	return PamSuccess, user, nil
 }
 
 // changeToken will change the users password
-func changeToken(username, oldpassword, newpassword string, quiet bool) (PamResult, error) {
-	// We require global state for the function. This function never takes
-	// ownership of the token, so it is not responsible for wiping it.
-	tokenLock.Lock()
-	tokenToCheck = oldpassword
-	tokenToSet = newpassword
-	defer func() {
-		tokenToCheck = ""
-		tokenToSet = ""
-		tokenLock.Unlock()
-	}()
-
-	transaction, err := start("axiospam", username)
+func changeToken(o *options, username, oldpassword, newpassword string, quiet bool) (PamResult, error) {
+	// This function never takes ownership of the token, so it is not
+	// responsible for wiping it.
+	if err := limit.acquire(o.ctx); err != nil {
+		return PamSystemERR, causeError(PamSystemERR, StageStart, err)
+	}
+	defer limit.release()
+
+	conv := newConversation(o, oldpassword, newpassword)
+	defer func() { o.messages = append(o.messages, conv.messages...) }()
+
+	transaction, err := begin(o, username, conv)
 	if err != nil {
 		return PamSystemERR, err
 	}
 	defer transaction.End()
 
 	// Ask PAM to authenticate the old Token First
-	if authenticated, err := transaction.authenticate(quiet); err != nil {
+	if authenticated, err := transaction.authenticate(quiet, o.flags); PamResult(transaction.status) == PamMaxTries {
+		return PamMaxTries, nil
+	} else if err != nil {
 		return PamSystemERR, err
 	} else if !authenticated {
 		return PamAuthERR, nil
 	}
 
-	tokenToSet = newpassword
-
 	// Ask PAM to change the token.
 	status, err := transaction.changeTok(quiet)
-	return PamResult(status), err
+	if err != nil || status != 0 || o.recheck == nil {
+		return PamResult(status), err
+	}
+
+	// See where the account stands now the token is changed
+	flags, err := transaction.accountManagement(true)
+	if err != nil {
+		return PamSystemERR, err
+	}
+	*o.recheck = PamResult(flags)
+
+	return PamSuccess, nil
 }
 
 // get the User Account Flags from PAM
-func getUserAccountFlags(username string, quiet bool) (PamResult, error) {
-	transaction, err := start("axiospam", username)
+func getUserAccountFlags(o *options, username string, quiet bool) (PamResult, error) {
+	if err := limit.acquire(o.ctx); err != nil {
+		return PamSystemERR, causeError(PamSystemERR, StageStart, err)
+	}
+	defer limit.release()
+
+	// The account stage has no secrets to give, but its messages are kept
+	// with this call and nobody elses.
+	conv := newConversation(o, "", "")
+	defer func() { o.messages = append(o.messages, conv.messages...) }()
+
+	transaction, err := begin(o, username, conv)
 	if err != nil {
 		return PamSystemERR, err
 	}
 	defer transaction.End()
 
-	// Ask PAM to authenticate the token.
+	// Ask PAM to check the account.
 	flags, err := transaction.accountManagement(quiet)
 	if err != nil {
 		return PamSystemERR, err
 	}
 
-	return PamResult(flags), nil
+	return PamResult(flags), loginsDisabled(PamResult(flags), conv)
 }
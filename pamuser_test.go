@@ -17,20 +17,22 @@
  * the License.
  */package axiospam_test
 
+import (
+	"fmt"
+
+	"github.com/mjwaxios/axiospam"
+)
+
 func Example() {
-	/*
-			p := axiospam.New("testana", "thisisatest123")
-		auth, reason := p.IsAuthenticated()
-		fmt.Printf("Person %s Authenticated: %v, Reason: %v\n", p.Username, auth, reason)
-		p.Authenticate()
-		auth, reason = p.IsAuthenticated()
-		//	fmt.Printf("Person %s Authenticated: %v, Reason: %v\n", p.Username, auth, reason)
-		p.SetPassword("BadPass")
-		auth, reason = p.Authenticate()
-		fmt.Printf("Person %s Authenticated: %v, Reason: %v\n", p.Username, auth, reason)
-		//	// Person testana Authenticated: true, Reason: <nil>
-		// Output:
-		// Person testana Authenticated: false, Reason: Authenticate not run yet
-		// Person testana Authenticated: false, Reason: incorrect login passphrase
-	*/
+	p := axiospam.New("testana", "thisisatest123")
+	auth, reason := p.IsAuthenticated()
+	fmt.Printf("Person %s Authenticated: %v, Reason: %v\n", p.Username, auth, reason)
+
+	auth, reason = p.Authenticate()
+	fmt.Printf("Person %s Authenticated: %v, Reason: %v\n", p.Username, auth, reason)
+
+	// Check the same person against a different stack
+	p.SetService("sudo-like")
+	auth, reason = p.Authenticate()
+	fmt.Printf("Person %s Authenticated with %s: %v, Reason: %v\n", p.Username, p.Service(), auth, reason)
 }
@@ -0,0 +1,174 @@
+/*
+ * prompt.go - Work out what a PAM conversation prompt is asking for.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+/*
+#include <security/pam_appl.h>
+*/
+import "C"
+
+import "strings"
+
+// MessageStyle is the PAM style of a conversation message.
+type MessageStyle int
+
+// PAM conversation message styles.
+const (
+	// PromptEchoOff asks for input that should not be shown, like a password.
+	PromptEchoOff MessageStyle = C.PAM_PROMPT_ECHO_OFF
+	// PromptEchoOn asks for input that can be shown, like a username.
+	PromptEchoOn MessageStyle = C.PAM_PROMPT_ECHO_ON
+	// ErrorMsg is an error message for the user.
+	ErrorMsg MessageStyle = C.PAM_ERROR_MSG
+	// TextInfo is an informational message for the user.
+	TextInfo MessageStyle = C.PAM_TEXT_INFO
+)
+
+// PromptKind is what a conversation prompt is asking for.
+type PromptKind int
+
+// Kinds of conversation prompts.
+const (
+	// PromptUnknown is a prompt the classifier could not place. Hidden
+	// prompts are answered with the password, then the new password.
+	PromptUnknown PromptKind = iota
+	// PromptPassword asks for the current password.
+	PromptPassword
+	// PromptNewPassword asks for, or asks to repeat, the new password.
+	PromptNewPassword
+	// PromptOTP asks for a one time code.
+	PromptOTP
+	// PromptPIN asks for a smartcard or token PIN.
+	PromptPIN
+	// PromptInformational is a message that needs no answer.
+	PromptInformational
+	// PromptUsername asks for the username.
+	PromptUsername
+	// PromptDevice asks the user to insert or touch a hardware token. As an
+	// info message it is handed to the device callback, as a prompt it is
+	// answered with an empty line after the device wait.
+	PromptDevice
+)
+
+// kinds Number to Strings
+var kinds = [...]string{
+	"Unknown",
+	"Password",
+	"NewPassword",
+	"OTP",
+	"PIN",
+	"Informational",
+	"Username",
+	"Device",
+}
+
+// String will convert a PromptKind to a String
+func (k PromptKind) String() string {
+	if int(k) < 0 || int(k) >= len(kinds) {
+		return "unknown PromptKind"
+	}
+
+	return kinds[k]
+}
+
+// PromptClassifier looks at each conversation prompt and labels it, so the
+// responder can answer it with the right secret.
+type PromptClassifier interface {
+	Classify(style MessageStyle, prompt string) PromptKind
+}
+
+// PromptClassifierFunc lets a plain function be used as a PromptClassifier.
+type PromptClassifierFunc func(style MessageStyle, prompt string) PromptKind
+
+// Classify calls f(style, prompt).
+func (f PromptClassifierFunc) Classify(style MessageStyle, prompt string) PromptKind {
+	return f(style, prompt)
+}
+
+// DefaultClassifier knows the prompts used by pam_unix, pam_sss,
+// pam_google_authenticator, pam_oath, pam_u2f and pam_yubico.
+var DefaultClassifier PromptClassifier = PromptClassifierFunc(classifyPrompt)
+
+// classifyPrompt is the heuristic behind DefaultClassifier. The order matters,
+// "New PIN" is a new token and "Password & verification code" wants the code.
+//
+//	pam_unix:                 "Password: ", "Current password: ", "New password: ",
+//	                          "Retype new password: "
+//	pam_sss:                  "First Factor: ", "Second Factor: ", "PIN for %s: ",
+//	                          "Reenter new Password: "
+//	pam_google_authenticator: "Verification code: "
+//	pam_oath:                 "One-time password (OATH) for `%s': "
+//	pam_u2f:                  "Please touch the device.", "Please enter the PIN: ",
+//	                          "Insert your U2F device, then press ENTER."
+//	pam_yubico:               "YubiKey for `%s': "
+func classifyPrompt(style MessageStyle, prompt string) PromptKind {
+	p := strings.ToLower(prompt)
+
+	// Hardware tokens talk to the user as info messages and prompts, but
+	// never ask for a secret, "Touch ID password: " still wants the password.
+	if style != PromptEchoOff && (strings.Contains(p, "touch") ||
+		(strings.Contains(p, "insert") && (strings.Contains(p, "device") || strings.Contains(p, "key")))) {
+		return PromptDevice
+	}
+
+	switch style {
+	case ErrorMsg, TextInfo:
+		return PromptInformational
+	}
+
+	// The username is the only thing asked for in the clear, "login: " is the
+	// Linux-PAM default.
+	if style == PromptEchoOn && (hasWord(p, "login") || hasWord(p, "user") || hasWord(p, "username")) {
+		return PromptUsername
+	}
+
+	switch {
+	case strings.Contains(p, "new"):
+		return PromptNewPassword
+	case strings.Contains(p, "verification code"),
+		strings.Contains(p, "one-time password"),
+		strings.Contains(p, "second factor"),
+		hasWord(p, "otp"),
+		strings.Contains(p, "passcode"),
+		strings.Contains(p, "token code"),
+		strings.Contains(p, "yubikey"):
+		return PromptOTP
+	case hasWord(p, "pin"):
+		return PromptPIN
+	case strings.Contains(p, "password"),
+		strings.Contains(p, "first factor"):
+		return PromptPassword
+	}
+
+	return PromptUnknown
+}
+
+// hasWord reports if word is in s on its own, not as part of a longer word.
+func hasWord(s, word string) bool {
+	f := strings.FieldsFunc(s, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	})
+	for _, w := range f {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
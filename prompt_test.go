@@ -0,0 +1,128 @@
+/*
+ * prompt_test.go - Tests for the default prompt classifier.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDefaultClassifier(t *testing.T) {
+	tests := []struct {
+		style  MessageStyle
+		prompt string
+		want   PromptKind
+	}{
+		// pam_unix
+		{PromptEchoOff, "Password: ", PromptPassword},
+		{PromptEchoOff, "Current password: ", PromptPassword},
+		{PromptEchoOff, "(current) UNIX password: ", PromptPassword},
+		{PromptEchoOff, "New password: ", PromptNewPassword},
+		{PromptEchoOff, "Retype new password: ", PromptNewPassword},
+		{ErrorMsg, "BAD PASSWORD: The password is shorter than 8 characters", PromptInformational},
+		// pam_sss
+		{PromptEchoOff, "First Factor: ", PromptPassword},
+		{PromptEchoOff, "Second Factor: ", PromptOTP},
+		{PromptEchoOff, "PIN for Smart Card: ", PromptPIN},
+		{PromptEchoOff, "Reenter new Password: ", PromptNewPassword},
+		// pam_google_authenticator
+		{PromptEchoOff, "Verification code: ", PromptOTP},
+		// pam_oath
+		{PromptEchoOff, "One-time password (OATH) for `testana': ", PromptOTP},
+		// pam_u2f
+		{TextInfo, "Please touch the device.", PromptDevice},
+		{PromptEchoOn, "Insert your U2F device, then press ENTER.", PromptDevice},
+		{PromptEchoOff, "Please enter the PIN: ", PromptPIN},
+		// a hidden prompt is never a device cue
+		{PromptEchoOff, "Touch ID password: ", PromptPassword},
+		// pam_yubico
+		{PromptEchoOff, "YubiKey for `testana': ", PromptOTP},
+		// no idea
+		{PromptEchoOff, "Shipping address: ", PromptUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := DefaultClassifier.Classify(tt.style, tt.prompt); got != tt.want {
+			t.Errorf("Classify(%q) = %v, want %v", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestConversationRespond(t *testing.T) {
+	c := newConversation(newOptions([]Option{WithOTP("123456")}), "old", "new")
+
+	if got := c.respond(PromptEchoOff, "Current password: "); got != "old" {
+		t.Errorf("password prompt got %q", got)
+	}
+	if got := c.respond(PromptEchoOff, "Retype new password: "); got != "new" {
+		t.Errorf("new password prompt got %q", got)
+	}
+	if got := c.respond(PromptEchoOff, "Verification code: "); got != "123456" {
+		t.Errorf("otp prompt got %q", got)
+	}
+
+	// Unknown hidden prompts keep the old password then new password order
+	if got := c.respond(PromptEchoOff, "Secret: "); got != "old" {
+		t.Errorf("first unknown prompt got %q", got)
+	}
+	if got := c.respond(PromptEchoOff, "Secret again: "); got != "new" {
+		t.Errorf("second unknown prompt got %q", got)
+	}
+}
+
+func TestConversationRespondAuthTokType(t *testing.T) {
+	o := newOptions(nil)
+	o.authtokType = "PIN"
+	c := newConversation(o, "1234", "5678")
+
+	if got := c.respond(PromptEchoOff, "PIN for Smart Card: "); got != "1234" {
+		t.Errorf("pin prompt got %q", got)
+	}
+	if got := c.respond(PromptEchoOff, "New PIN: "); got != "5678" {
+		t.Errorf("new pin prompt got %q", got)
+	}
+
+	o.authtokType = "OTP"
+	c = newConversation(o, "old-seed", "new-seed")
+	if got := c.respond(PromptEchoOff, "Verification code: "); got != "old-seed" {
+		t.Errorf("otp prompt got %q", got)
+	}
+}
+
+func TestConversationDeviceWaitCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := newConversation(newOptions([]Option{WithContext(ctx), WithDeviceWait(time.Hour)}), "old", "new")
+
+	done := make(chan struct{})
+	go func() {
+		c.respond(PromptEchoOn, "Insert your U2F device, then press ENTER.")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("device wait ignored the cancelled context")
+	}
+	if !c.cancelled {
+		t.Error("conversation not marked cancelled")
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * request.go - Authenticate from a single request struct.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import "context"
+
+// AuthRequest is everything about one authentication. New settings are added
+// here as fields, so they do not need new function signatures.
+type AuthRequest struct {
+	// User is the username, if empty the stack asks for it (see
+	// WithPromptedUser).
+	User     string
+	Password string
+	// Token is the callers GSSAPI token for keytab.Authenticator, PAM
+	// ignores it.
+	Token []byte
+	// Service is the PAM service, DefaultService if empty.
+	Service string
+	// RHost and TTY are set as PAM_RHOST and PAM_TTY if not empty.
+	RHost string
+	TTY   string
+	// Flags are added to the pam_authenticate call.
+	Flags Flag
+}
+
+// AuthResult is the outcome of AuthenticateContext.
+type AuthResult struct {
+	// Result is what Authenticate returns, on success it holds the account
+	// flags such as PamNewAuthTokReqd.
+	Result PamResult
+	// User is the user the stack settled on, which a module may have asked
+	// for or mapped.
+	User string
+	// Messages are the error and info texts the stack sent.
+	Messages []string
+}
+
+// AuthenticateContext checks the request with PAM. Options are applied before
+// the request fields, so the request wins where both set the same thing.
+func AuthenticateContext(ctx context.Context, req AuthRequest, opts ...Option) (AuthResult, error) {
+	o := newOptions(opts)
+	o.ctx = ctx
+	return authenticateRequest(o, req)
+}
+
+// authenticateRequest is AuthenticateContext after the options are set up.
+func authenticateRequest(o *options, req AuthRequest) (AuthResult, error) {
+	if req.Service != "" {
+		o.service = req.Service
+	}
+	if req.RHost != "" {
+		o.rhost = req.RHost
+	}
+	if req.TTY != "" {
+		o.tty = req.TTY
+	}
+	o.flags |= req.Flags
+
+	r, user, err := authenticate(o, req.User, req.Password)
+	if user == "" {
+		user = req.User
+	}
+	audit(o, OpAuthenticate, user, r, err)
+	firstLogin(user, err)
+	return AuthResult{
+		Result:   r,
+		User:     user,
+		Messages: o.messages,
+	}, requestError(o, user, err)
+}
@@ -0,0 +1,68 @@
+/*
+ * retry.go - Backoff for transient PAM failures.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryPolicy is how often, and how far apart, a transient failure is retried.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+// defaultRetry covers a concurrent passwd run or a short NIS/LDAP hiccup
+// without holding the caller for more than a couple of seconds.
+var defaultRetry = retryPolicy{
+	attempts: 3,
+	base:     100 * time.Millisecond,
+	max:      2 * time.Second,
+}
+
+// retryable reports if the status is one that may clear up on its own.
+func (r retryPolicy) retryable(status PamResult) bool {
+	switch status {
+	case PamAuthTokLockBusy, PamTryAgain:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait after the given (1 based) attempt failed.
+// Half of the delay is fixed and half is random, so callers that failed
+// together do not all come back at the same time.
+func (r retryPolicy) backoff(attempt int) time.Duration {
+	d := r.base
+	for i := 1; i < attempt && d < r.max; i++ {
+		d *= 2
+	}
+	if d > r.max {
+		d = r.max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
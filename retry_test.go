@@ -0,0 +1,59 @@
+/*
+ * retry_test.go - Tests for the transient failure backoff.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	r := retryPolicy{attempts: 5, base: 100 * time.Millisecond, max: time.Second}
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, max := range want {
+		for n := 0; n < 50; n++ {
+			d := r.backoff(i + 1)
+			if d < max/2 || d > max {
+				t.Fatalf("attempt %d: backoff %v outside [%v, %v]", i+1, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, s := range []PamResult{PamAuthTokLockBusy, PamTryAgain} {
+		if !defaultRetry.retryable(s) {
+			t.Errorf("%v should be retryable", s)
+		}
+	}
+	for _, s := range []PamResult{PamSuccess, PamAuthERR, PamAuthTokERR} {
+		if defaultRetry.retryable(s) {
+			t.Errorf("%v should not be retryable", s)
+		}
+	}
+}
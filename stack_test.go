@@ -0,0 +1,539 @@
+/*
+ * stack_test.go - Run the package calls against inline pam_permit/pam_deny
+ * stacks.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	permitStack = "auth required pam_permit.so\naccount required pam_permit.so\npassword required pam_permit.so\n"
+	denyAuth    = "auth required pam_deny.so\naccount required pam_permit.so\npassword required pam_permit.so\n"
+	denyPass    = "auth required pam_permit.so\naccount required pam_permit.so\npassword required pam_deny.so\n"
+)
+
+var (
+	inlineOnce sync.Once
+	inlineErr  error
+)
+
+// needInlineStack skips a test that can not run an inline stack here. The
+// stacks need pam_start_confdir, from Linux-PAM 1.4, and check root.
+func needInlineStack(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("inline stack tests must be run as root")
+	}
+	inlineOnce.Do(func() {
+		_, inlineErr = Authenticate("root", "secret", WithInlineStack(permitStack))
+	})
+	if errors.Is(inlineErr, PamSymbolERR) {
+		t.Skip("libpam has no pam_start_confdir, Linux-PAM 1.4 or newer is needed")
+	}
+}
+
+func TestInlineStackAuthenticate(t *testing.T) {
+	needInlineStack(t)
+	tests := []struct {
+		stack string
+		want  PamResult
+	}{
+		{permitStack, PamSuccess},
+		{denyAuth, PamAuthERR},
+	}
+
+	for _, tt := range tests {
+		got, err := Authenticate("root", "secret", WithInlineStack(tt.stack))
+		if got != tt.want {
+			t.Errorf("Authenticate with %q = %v (%v), want %v", tt.stack, got, err, tt.want)
+		}
+	}
+}
+
+func TestInlineStackServiceName(t *testing.T) {
+	needInlineStack(t)
+	for _, service := range []string{"", "..", "../../etc/shadow", "a/b"} {
+		_, err := Authenticate("root", "secret", WithInlineStack(permitStack), WithService(service))
+		if !errors.Is(err, PamServiceERR) {
+			t.Errorf("service %q: got %v, want SERVICE_ERR", service, err)
+		}
+	}
+}
+
+func TestInlineStackChangePassword(t *testing.T) {
+	needInlineStack(t)
+	tests := []struct {
+		stack string
+		want  PamResult
+	}{
+		{permitStack, PamSuccess},
+		{denyPass, PamAuthTokERR},
+	}
+
+	for _, tt := range tests {
+		got, err := ChangePassword("root", "old", "new", WithInlineStack(tt.stack))
+		if got != tt.want {
+			t.Errorf("ChangePassword with %q = %v (%v), want %v", tt.stack, got, err, tt.want)
+		}
+	}
+}
+
+func TestInlineStackChangePIN(t *testing.T) {
+	needInlineStack(t)
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// pam_exec saves the token the auth stage was given, pam_stress asks for
+	// the new one twice and only keeps it in the transaction. Nothing outside
+	// dir is written.
+	script := filepath.Join(dir, "save")
+	save := "#!/bin/sh\ncat > " + dir + "/old\n"
+	if err := ioutil.WriteFile(script, []byte(save), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stack := "auth required pam_exec.so expose_authtok " + script + "\n" +
+		"account required pam_permit.so\n" +
+		"password required pam_stress.so rootok\n"
+
+	kinds := map[string]PromptKind{}
+	record := PromptClassifierFunc(func(style MessageStyle, prompt string) PromptKind {
+		kind := DefaultClassifier.Classify(style, prompt)
+		kinds[prompt] = kind
+		return kind
+	})
+
+	got, err := ChangePIN("root", "1234", "5678", WithInlineStack(stack), WithPromptClassifier(record))
+	if err != nil || got != PamSuccess {
+		t.Fatalf("ChangePIN = %v (%v)", got, err)
+	}
+
+	old, err := ioutil.ReadFile(filepath.Join(dir, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes.TrimRight(old, "\x00")) != "1234" {
+		t.Errorf("auth stage got %q, want the old PIN", old)
+	}
+
+	if kind, ok := kinds["Enter new STRESS password: "]; !ok || kind != PromptNewPassword {
+		t.Errorf("new token prompt not asked or not answered with the new PIN: %v", kinds)
+	}
+}
+
+func TestInlineStackError(t *testing.T) {
+	needInlineStack(t)
+	_, err := Authenticate("root", "secret", WithInlineStack(denyAuth))
+
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected *Error, got %T: %v", err, err)
+	}
+	if perr.Code != PamAuthERR || perr.Stage != StageAuthenticate || perr.Message == "" {
+		t.Errorf("unexpected error %+v", perr)
+	}
+	if !errors.Is(err, PamAuthERR) {
+		t.Errorf("errors.Is(%v, PamAuthERR) = false", err)
+	}
+}
+
+func TestInlineStackRequestInfo(t *testing.T) {
+	needInlineStack(t)
+	_, err := ChangePassword("root", "old", "new", WithInlineStack(denyPass), WithRHost("192.0.2.1"))
+
+	info, ok := RequestInfo(err)
+	if !ok {
+		t.Fatalf("no RequestError in %v", err)
+	}
+	if info.Stage != StageChangeTok || info.RHost != "192.0.2.1" || info.Attempt != 1 ||
+		info.Service != DefaultService || len(info.UserHash) != 64 {
+		t.Errorf("unexpected RequestError %+v", info)
+	}
+	if !errors.Is(err, PamAuthTokERR) {
+		t.Errorf("RequestError hides the code: %v", err)
+	}
+
+	_, err = Authenticate("root", "secret", WithInlineStack(denyAuth))
+	if info, ok := RequestInfo(err); !ok || info.Stage != StageAuthenticate {
+		t.Errorf("Authenticate error %v has no stage", err)
+	}
+}
+
+func TestInlineStackAccountRecheck(t *testing.T) {
+	needInlineStack(t)
+	status := PamSystemERR
+	got, err := ChangePassword("root", "old", "new", WithInlineStack(permitStack), WithAccountRecheck(&status))
+	if got != PamSuccess || err != nil {
+		t.Fatalf("ChangePassword = %v (%v)", got, err)
+	}
+	if status != PamSuccess {
+		t.Errorf("account recheck = %v, want %v", status, PamSuccess)
+	}
+}
+
+type recordAuditor struct {
+	events []AuditEvent
+}
+
+func (r *recordAuditor) Audit(ev AuditEvent) error {
+	r.events = append(r.events, ev)
+	return nil
+}
+
+// addingAuditor adds another Auditor from inside Audit.
+type addingAuditor struct{}
+
+func (addingAuditor) Audit(ev AuditEvent) error {
+	AddAuditor(&recordAuditor{})
+	return nil
+}
+
+// resetAuditors drops the Auditors a test added.
+func resetAuditors() {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	auditors = nil
+}
+
+func TestInlineStackAuditChangeTok(t *testing.T) {
+	needInlineStack(t)
+	rec := &recordAuditor{}
+	AddAuditor(rec)
+	defer resetAuditors()
+
+	ChangePassword("root", "old", "new", WithInlineStack(denyPass))
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d audit events, want 1", len(rec.events))
+	}
+	ev := rec.events[0]
+	if ev.Op != OpChangeTok || ev.Success() || ev.Result != PamAuthTokERR || ev.Stage != StageChangeTok {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+}
+
+func TestInlineStackAuditAuthenticate(t *testing.T) {
+	needInlineStack(t)
+	rec := &recordAuditor{}
+	AddAuditor(rec)
+	defer resetAuditors()
+
+	Authenticate("root", "secret", WithInlineStack(denyAuth))
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d audit events, want 1", len(rec.events))
+	}
+	ev := rec.events[0]
+	if ev.Op != OpAuthenticate || ev.Success() || ev.User != "root" || ev.Stage != StageAuthenticate {
+		t.Errorf("unexpected audit event %+v", ev)
+	}
+}
+
+func TestInlineStackAuditorAddsAuditor(t *testing.T) {
+	needInlineStack(t)
+	AddAuditor(addingAuditor{})
+	defer resetAuditors()
+
+	done := make(chan struct{})
+	go func() {
+		Authenticate("root", "secret", WithInlineStack(permitStack))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Authenticate deadlocked on an Auditor that adds another")
+	}
+}
+
+func TestInlineStackFirstLogin(t *testing.T) {
+	needInlineStack(t)
+	var calls []string
+	OnFirstLogin(NewMemorySeenStore(), func(user string) error {
+		calls = append(calls, user)
+		return nil
+	})
+	defer resetFirstLogin()
+
+	Authenticate("root", "secret", WithInlineStack(denyAuth))
+	Authenticate("root", "secret", WithInlineStack(permitStack))
+	Authenticate("root", "secret", WithInlineStack(permitStack))
+
+	if len(calls) != 1 || calls[0] != "root" {
+		t.Errorf("hook calls = %q, want one for root", calls)
+	}
+}
+
+func TestInlineStackPromptedUser(t *testing.T) {
+	needInlineStack(t)
+	p := New("", "secret")
+	ok, err := p.Authenticate(WithInlineStack(permitStack), WithPromptedUser("root"), WithUserPrompt("Who are you? "))
+	if !ok {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Username != "root" {
+		t.Errorf("Username = %q, want root", p.Username)
+	}
+}
+
+func TestAuthenticateContextRequest(t *testing.T) {
+	needInlineStack(t)
+	stack := "auth required pam_succeed_if.so quiet rhost = 192.0.2.1 tty = pts/7\n" + permitStack
+
+	req := AuthRequest{User: "root", Password: "secret", RHost: "192.0.2.1", TTY: "pts/7"}
+	res, err := AuthenticateContext(context.Background(), req, WithInlineStack(stack))
+	if err != nil || res.Result != PamSuccess || res.User != "root" {
+		t.Errorf("AuthenticateContext = %+v (%v)", res, err)
+	}
+
+	req.RHost = "192.0.2.2"
+	if res, err := AuthenticateContext(context.Background(), req, WithInlineStack(stack)); err == nil {
+		t.Errorf("AuthenticateContext from the wrong host = %+v", res)
+	}
+}
+
+func TestPAMAuthenticator(t *testing.T) {
+	needInlineStack(t)
+	var a Authenticator = NewPAMAuthenticator(WithInlineStack(permitStack))
+
+	res, err := a.Authenticate(context.Background(), AuthRequest{User: "root", Password: "secret"})
+	if err != nil || res.Result != PamSuccess {
+		t.Errorf("Authenticate = %+v (%v)", res, err)
+	}
+}
+
+func TestInlineStackTimeoutHint(t *testing.T) {
+	needInlineStack(t)
+	// printenv fails when the variable is not set
+	stack := "auth required pam_exec.so quiet /usr/bin/printenv " + DeadlineEnv + "\n" + permitStack
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := Authenticate("root", "secret", WithInlineStack(stack), WithContext(ctx)); err == nil {
+		t.Errorf("Authenticate without the hint passed")
+	}
+	if _, err := Authenticate("root", "secret", WithInlineStack(stack), WithContext(ctx), WithStackTimeoutHint()); err != nil {
+		t.Errorf("Authenticate with the hint = %v", err)
+	}
+}
+
+func TestInlineStackMessagesPerCall(t *testing.T) {
+	needInlineStack(t)
+	dir, err := ioutil.TempDir("", "axiospam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// pam_nologin shows root the notice from the account stage, even silent
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		text := fmt.Sprintf("account note %d", i)
+		file := filepath.Join(dir, fmt.Sprint(i))
+		if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stack := "auth required pam_permit.so\naccount required pam_nologin.so file=" + file + "\naccount required pam_permit.so\n"
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := AuthenticateContext(context.Background(), AuthRequest{User: "root", Password: "secret"}, WithInlineStack(stack))
+			if err != nil {
+				t.Errorf("%d: %v", i, err)
+				return
+			}
+			for _, m := range res.Messages {
+				if m != text {
+					t.Errorf("%d: got another calls message %q", i, m)
+				}
+			}
+			if len(res.Messages) == 0 {
+				t.Errorf("%d: account stage message lost", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestInlineStackNologin(t *testing.T) {
+	needInlineStack(t)
+	f, err := ioutil.TempFile("", "nologin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Back at 10:00 after maintenance\n")
+	f.Close()
+
+	stack := "auth required pam_permit.so\naccount required pam_nologin.so file=" + f.Name() + "\npassword required pam_permit.so\n"
+
+	// Logging in and changing the password are refused the same way
+	got, err := Authenticate("nobody", "secret", WithInlineStack(stack))
+	checkNologin(t, "Authenticate", got, err)
+	got, err = ChangePassword("nobody", "old", "new", WithInlineStack(stack))
+	checkNologin(t, "ChangePassword", got, err)
+}
+
+func checkNologin(t *testing.T, call string, got PamResult, err error) {
+	t.Helper()
+	if got != PamAuthERR {
+		t.Errorf("%s = %v, want %v", call, got, PamAuthERR)
+	}
+	var nologin ErrLoginsDisabled
+	if !errors.As(err, &nologin) {
+		t.Fatalf("%s: expected ErrLoginsDisabled, got %T: %v", call, err, err)
+	}
+	if nologin.Message != "Back at 10:00 after maintenance" {
+		t.Errorf("%s: Message = %q", call, nologin.Message)
+	}
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Stage != StageAccount {
+		t.Errorf("%s: expected an account stage *Error, got %T: %v", call, err, err)
+	}
+}
+
+func TestInlineStackAccountDenied(t *testing.T) {
+	needInlineStack(t)
+	// A refusal with no notice is not put down to nologin
+	stack := "auth required pam_permit.so\naccount required pam_deny.so\n"
+	_, err := Authenticate("nobody", "secret", WithInlineStack(stack))
+
+	if errors.As(err, new(ErrLoginsDisabled)) {
+		t.Fatalf("got ErrLoginsDisabled for a plain account denial: %v", err)
+	}
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Stage != StageAccount {
+		t.Errorf("expected an account stage *Error, got %T: %v", err, err)
+	}
+}
+
+func TestInlineStackDeviceEvent(t *testing.T) {
+	needInlineStack(t)
+	got := make(chan string, 1)
+	stack := "auth optional pam_echo.so Please touch the device.\n" + permitStack
+
+	_, err := Authenticate("root", "secret", WithInlineStack(stack), WithDeviceEvent(func(msg string) {
+		got <- msg
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-got:
+		if msg != "Please touch the device." {
+			t.Errorf("device event = %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("no device event")
+	}
+}
+
+func TestInlineStackContextError(t *testing.T) {
+	needInlineStack(t)
+	// Hold the only slot so the call waits on its context
+	SetConcurrencyLimit(1)
+	defer SetConcurrencyLimit(0)
+	if err := limit.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer limit.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := AuthenticateContext(ctx, AuthRequest{User: "root", Password: "secret"}, WithInlineStack(permitStack))
+
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Stage != StageStart {
+		t.Fatalf("expected a start stage *Error, got %T: %v", err, err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("errors.Is(%v, DeadlineExceeded) = false", err)
+	}
+}
+
+func TestInlineStackConcurrent(t *testing.T) {
+	needInlineStack(t)
+	// Two slow transactions under a limit of two should overlap
+	SetConcurrencyLimit(2)
+	defer SetConcurrencyLimit(0)
+
+	stack := "auth required pam_exec.so quiet /bin/sleep 0.5\n" + permitStack
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Authenticate("root", "secret", WithInlineStack(stack)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("two transactions took %v, they did not run at the same time", d)
+	}
+}
+
+func TestInlineStackDeviceWaitAlone(t *testing.T) {
+	needInlineStack(t)
+	// Take the password prompt as a device prompt, so the call sits in its wait
+	device := PromptClassifierFunc(func(MessageStyle, string) PromptKind { return PromptDevice })
+	stack := "auth required pam_exec.so quiet expose_authtok /bin/true\n" + permitStack
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan struct{})
+	go func() {
+		AuthenticateContext(ctx, AuthRequest{User: "root", Password: "secret"}, WithInlineStack(stack),
+			WithPromptClassifier(device), WithDeviceWait(time.Hour), WithDeviceEvent(func(string) { close(waiting) }))
+	}()
+	defer cancel()
+	<-waiting
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Authenticate("root", "secret", WithInlineStack(permitStack))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a device wait held up another login")
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * watch.go - Watch an account for changes that should end its sessions.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"time"
+)
+
+// AccountChange is the kind of change Watch saw on an account.
+type AccountChange int
+
+// Account changes reported by Watch.
+const (
+	// AccountLocked is the password being locked (passwd -l) or a faillock
+	// lock out starting.
+	AccountLocked AccountChange = iota + 1
+	// AccountUnlocked is the lock being lifted.
+	AccountUnlocked
+	// AccountExpired is the account stage starting to answer ACCT_EXPIRED.
+	AccountExpired
+	// PasswordExpired is the account stage starting to answer
+	// NEW_AUTHTOK_REQD.
+	PasswordExpired
+	// PasswordChanged is the password being changed, by anyone.
+	PasswordChanged
+	// AccountRemoved is the user no longer being known to the system.
+	AccountRemoved
+)
+
+// changes Number to Strings
+var changes = [...]string{
+	"",
+	"AccountLocked",
+	"AccountUnlocked",
+	"AccountExpired",
+	"PasswordExpired",
+	"PasswordChanged",
+	"AccountRemoved",
+}
+
+// String will convert an AccountChange to a String
+func (c AccountChange) String() string {
+	if int(c) <= 0 || int(c) >= len(changes) {
+		return "unknown AccountChange"
+	}
+
+	return changes[c]
+}
+
+// DefaultWatchInterval is the poll interval Watch uses when given one of 0
+// or less.
+const DefaultWatchInterval = time.Minute
+
+// AccountEvent is one change seen by Watch.
+type AccountEvent struct {
+	User   string
+	Change AccountChange
+	// Status is the account stage result when the change was seen.
+	Status PamResult
+	Time   time.Time
+}
+
+// accountState is what Watch compares between polls.
+type accountState struct {
+	exists bool
+	status PamResult
+	locked bool
+	// lastChange and hash come from the shadow entry, hash is a digest so
+	// the password hash itself is not kept around.
+	shadow     bool
+	lastChange int64
+	hash       [sha256.Size]byte
+}
+
+// Watch polls the account every interval and sends an AccountEvent for each
+// change that should end a long lived session: locked, expired, removed, or
+// the password changed somewhere else. The first poll is the baseline and
+// sends nothing. The channel is closed when ctx is done. An interval of 0 or
+// less polls every DefaultWatchInterval.
+//
+// The account stage runs with the given Options. Locks and password changes
+// come from the shadow entry and faillock tally, which normally need root;
+// without them only account stage changes are seen.
+func Watch(ctx context.Context, name string, interval time.Duration, opts ...Option) <-chan AccountEvent {
+	events := make(chan AccountEvent)
+	o := newOptions(opts)
+	o.ctx = ctx
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	go func() {
+		defer close(events)
+
+		prev := pollAccount(o, name)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			cur := pollAccount(o, name)
+			for _, change := range diffAccount(prev, cur) {
+				ev := AccountEvent{
+					User:   name,
+					Change: change,
+					Status: cur.status,
+					Time:   time.Now(),
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+
+	return events
+}
+
+// ValidUntil returns when the users credentials lapse going by shadow aging,
+// the earlier of the account expire date and the password passing its
+// maximum age. A long lived session can close at that time, see
+// AfterValidUntil, with Watch to catch changes made before then. A zero time means
+// no limit, or no shadow entry we can read, which normally needs root.
+func ValidUntil(name string) (time.Time, error) {
+	entry, found, err := lookupShadow(name)
+	if err != nil || !found {
+		return time.Time{}, err
+	}
+
+	return shadowValidUntil(entry), nil
+}
+
+// AfterValidUntil calls fn in its own goroutine at the time ValidUntil gives,
+// so a long lived session can close itself when the credentials lapse. A time
+// already past calls fn at once; with no limit fn is never called. stop
+// cancels the call, it reports false if fn has already run or never will.
+func AfterValidUntil(name string, fn func()) (stop func() bool, err error) {
+	until, err := ValidUntil(name)
+	if err != nil {
+		return nil, err
+	}
+	return afterUntil(until, fn), nil
+}
+
+// afterUntil calls fn at until, never for the zero time.
+func afterUntil(until time.Time, fn func()) (stop func() bool) {
+	if until.IsZero() {
+		return func() bool { return false }
+	}
+	return time.AfterFunc(time.Until(until), fn).Stop
+}
+
+// shadowValidUntil uses the same day counts as pam_unix. A last change of 0,
+// password must be changed, gives the epoch, which is already past.
+func shadowValidUntil(e shadowEntry) time.Time {
+	var until time.Time
+	earlier := func(days int64) {
+		t := time.Unix(days*24*60*60, 0)
+		if until.IsZero() || t.Before(until) {
+			until = t
+		}
+	}
+
+	if e.expire >= 0 {
+		earlier(e.expire)
+	}
+	switch {
+	case e.lastChange == 0:
+		earlier(0)
+	case e.lastChange > 0 && e.max >= 0 && e.max < 99999:
+		// Expired once the days since the change are more than max
+		earlier(e.lastChange + e.max + 1)
+	}
+
+	return until
+}
+
+// pollAccount gathers the current state of the account.
+func pollAccount(o *options, name string) accountState {
+	var s accountState
+
+	exists, err := lookupUser(name)
+	s.exists = exists || err != nil
+	if !s.exists {
+		return s
+	}
+
+	s.status, _ = getUserAccountFlags(o, name, true)
+
+	if entry, found, _ := lookupShadow(name); found {
+		s.shadow = true
+		s.lastChange = entry.lastChange
+		s.hash = sha256.Sum256([]byte(entry.hash))
+		s.locked = strings.HasPrefix(entry.hash, "!")
+	}
+
+	if until, err := faillockUntil(readFaillockConfig(faillockConf), name); err == nil && until.After(time.Now()) {
+		s.locked = true
+	}
+
+	return s
+}
+
+// diffAccount lists the changes between two polls.
+func diffAccount(prev, cur accountState) []AccountChange {
+	var out []AccountChange
+
+	if prev.exists && !cur.exists {
+		return append(out, AccountRemoved)
+	}
+
+	switch {
+	case !prev.locked && cur.locked:
+		out = append(out, AccountLocked)
+	case prev.locked && !cur.locked:
+		out = append(out, AccountUnlocked)
+	}
+
+	if prev.status != cur.status {
+		switch cur.status {
+		case PamAcctExpired:
+			out = append(out, AccountExpired)
+		case PamNewAuthTokReqd, PamAuthTokExpired:
+			out = append(out, PasswordExpired)
+		}
+	}
+
+	// Locking and unlocking also rewrite the hash, that is not a new password
+	if prev.shadow && cur.shadow && prev.locked == cur.locked &&
+		(prev.hash != cur.hash || prev.lastChange != cur.lastChange) {
+		out = append(out, PasswordChanged)
+	}
+
+	return out
+}
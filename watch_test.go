@@ -0,0 +1,140 @@
+/*
+ * watch_test.go - Tests for the account watcher.
+ *
+ * Copyright 2020 Michael Wyrick
+ * Author: Michael Wyrick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package axiospam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShadowValidUntil(t *testing.T) {
+	day := func(d int64) time.Time { return time.Unix(d*24*60*60, 0) }
+
+	tests := []struct {
+		name  string
+		entry shadowEntry
+		want  time.Time
+	}{
+		{"no limits", shadowEntry{lastChange: 18000, max: -1, expire: -1}, time.Time{}},
+		{"max 99999", shadowEntry{lastChange: 18000, max: 99999, expire: -1}, time.Time{}},
+		{"password age", shadowEntry{lastChange: 18000, max: 90, expire: -1}, day(18091)},
+		{"account expire", shadowEntry{lastChange: 18000, max: -1, expire: 18050}, day(18050)},
+		{"earlier wins", shadowEntry{lastChange: 18000, max: 90, expire: 18050}, day(18050)},
+		{"must change", shadowEntry{lastChange: 0, max: 90, expire: 18050}, day(0)},
+	}
+
+	for _, tt := range tests {
+		if got := shadowValidUntil(tt.entry); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffAccount(t *testing.T) {
+	base := accountState{exists: true, shadow: true, lastChange: 18000}
+
+	locked := base
+	locked.locked = true
+	if got := diffAccount(base, locked); len(got) != 1 || got[0] != AccountLocked {
+		t.Errorf("lock: got %v", got)
+	}
+
+	changed := base
+	changed.lastChange++
+	if got := diffAccount(base, changed); len(got) != 1 || got[0] != PasswordChanged {
+		t.Errorf("change: got %v", got)
+	}
+
+	if got := diffAccount(base, accountState{}); len(got) != 1 || got[0] != AccountRemoved {
+		t.Errorf("remove: got %v", got)
+	}
+}
+
+func TestWatchInterval(t *testing.T) {
+	needInlineStack(t)
+	// A bad interval must not take the process down from the goroutine
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := Watch(ctx, "root", interval, WithInlineStack(permitStack))
+		cancel()
+
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Errorf("interval %v: got an event for an unchanged account", interval)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("interval %v: channel not closed after cancel", interval)
+		}
+	}
+}
+
+func TestWatchUnchanged(t *testing.T) {
+	needInlineStack(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	for ev := range Watch(ctx, "root", time.Millisecond, WithInlineStack(permitStack)) {
+		t.Errorf("got %v for an unchanged account", ev.Change)
+	}
+}
+
+func TestAfterUntil(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	fn := func() { fired <- struct{}{} }
+
+	// Already past, fn runs at once
+	afterUntil(time.Now().Add(-time.Hour), fn)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fn not called for a time already past")
+	}
+
+	// Stopped before it is due
+	stop := afterUntil(time.Now().Add(time.Hour), fn)
+	if !stop() {
+		t.Error("stop = false for a pending call")
+	}
+
+	// No limit, nothing to stop
+	if stop := afterUntil(time.Time{}, fn); stop() {
+		t.Error("stop = true with no limit")
+	}
+
+	select {
+	case <-fired:
+		t.Error("fn called after stop or with no limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestAfterValidUntilUnknownUser(t *testing.T) {
+	stop, err := AfterValidUntil("no-such-user-axiospam", func() {
+		t.Error("fn called for an unknown user")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop() {
+		t.Error("stop = true for an unknown user")
+	}
+}